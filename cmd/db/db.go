@@ -1,28 +1,40 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 
 	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbrpc"
+	"github.com/VictorGOcking/lab-4/dbserver"
 	"github.com/VictorGOcking/lab-4/httptools"
+	"github.com/VictorGOcking/lab-4/resp"
 	"github.com/VictorGOcking/lab-4/signal"
 )
 
-var port = flag.Int("port", 8085, "server port")
-
-type ResponseStruct struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
-
-type RequestStruct struct {
-	Value string `json:"value"`
-}
+const segmentSize = 150
+
+var (
+	port         = flag.Int("port", 8085, "server port")
+	grpcPort     = flag.Int("grpc-port", 8086, "gRPC server port, 0 disables gRPC")
+	respPort     = flag.Int("resp-port", 0, "Redis protocol port, 0 disables it")
+	authConfig   = flag.String("auth-config", "", "API keys and permissions file, authentication is off without it")
+	auditLog     = flag.String("audit-log", "", "file to append denied requests to, stderr by default")
+	maxKeySize   = flag.Int("max-key-size", datastore.DefaultMaxKeySize, "largest key in bytes")
+	maxValueSize = flag.Int("max-value-size", datastore.DefaultMaxValueSize, "largest value in bytes")
+	maxBodySize  = flag.Int64("max-body-size", 8<<20, "largest request body in bytes, bulk imports are limited per record")
+	writeQueue   = flag.Int("write-queue", datastore.DefaultWriteQueueSize, "writes that may wait for the writer before new ones are rejected")
+	rateLimit    = flag.Float64("rate-limit", 0, "writes per second allowed to each client, 0 disables the limit")
+	rateBurst    = flag.Int("rate-burst", 100, "writes a client may make in a burst before the rate limit applies")
+	engineName   = flag.String("engine", "hash", "storage engine: hash (append-only log) or lsm")
+)
 
 func main() {
 	flag.Parse()
@@ -32,63 +44,116 @@ func main() {
 		log.Fatalf("Failed to create temp directory: %v", err)
 	}
 
-	db, err := datastore.NewDb(dir, 150)
+	db, err := datastore.OpenEngine(*engineName, dir, segmentSize, options())
 	if err != nil {
 		log.Fatalf("Failed to create datastore: %v", err)
 	}
 	defer db.Close()
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		handleDBRequest(rw, req, db)
-	})
+	namespaces, err := datastore.OpenNamespaces(filepath.Join(dir, "namespaces"), segmentSize, *engineName, options())
+	if err != nil {
+		log.Fatalf("Failed to open namespaces: %v", err)
+	}
+	defer namespaces.Close()
 
-	server := httptools.CreateServer(*port, mux)
+	handler := dbserver.New(db, namespaces, limits()).Handler()
+	if *authConfig != "" {
+		handler = withAuth(handler)
+	}
+	if *rateLimit > 0 {
+		handler = dbserver.NewRateLimiter(*rateLimit, *rateBurst).Wrap(handler)
+	}
+
+	httpServer := httptools.CreateServer(*port, handler)
 	go func() {
-		server.Start()
+		httpServer.Start()
 	}()
 
+	if *grpcPort != 0 {
+		startGRPC(db)
+	}
+	if *respPort != 0 {
+		startRESP(db)
+	}
+
 	signal.WaitForTerminationSignal()
 }
 
-func handleDBRequest(rw http.ResponseWriter, req *http.Request, db *datastore.Db) {
-	key := req.URL.Path[len("/db/"):]
-
-	switch req.Method {
-	case http.MethodGet:
-		handleGetRequest(rw, key, db)
-	case http.MethodPost:
-		handlePostRequest(rw, req, key, db)
-	default:
-		http.Error(rw, "Bad request method", http.StatusBadRequest)
+func limits() dbserver.Limits {
+	return dbserver.Limits{
+		MaxKeySize:   *maxKeySize,
+		MaxValueSize: *maxValueSize,
+		MaxBodySize:  *maxBodySize,
 	}
 }
 
-func handleGetRequest(rw http.ResponseWriter, key string, db *datastore.Db) {
-	value, err := db.Get(key)
+func options() datastore.Options {
+	opts := limits().Options()
+	opts.WriteQueueSize = *writeQueue
+	return opts
+}
+
+func withAuth(next http.Handler) http.Handler {
+	config, err := dbserver.LoadAuthConfig(*authConfig)
 	if err != nil {
-		http.Error(rw, fmt.Sprintf("Key not found: %v", err), http.StatusNotFound)
-		return
+		log.Fatalf("Failed to load auth config: %v", err)
 	}
 
-	rw.Header().Set("Content-Type", "application/json")
-	rw.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(rw).Encode(ResponseStruct{Key: key, Value: value}); err != nil {
-		http.Error(rw, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	audit := io.Writer(os.Stderr)
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		audit = f
 	}
+
+	auth := dbserver.NewAuthenticator(config, audit)
+	auth.MaxBodySize = *maxBodySize
+	return auth.Wrap(next)
 }
 
-func handlePostRequest(rw http.ResponseWriter, req *http.Request, key string, db *datastore.Db) {
-	var body RequestStruct
-	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
-		http.Error(rw, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+// startGRPC serves the gRPC API next to the HTTP one. It needs the hash
+// engine, which supports scans and watches.
+func startGRPC(engine datastore.Engine) {
+	db, ok := engine.(*datastore.Db)
+	if !ok {
+		log.Printf("gRPC API is not supported by the %s engine", *engineName)
 		return
 	}
 
-	if err := db.Put(key, body.Value); err != nil {
-		http.Error(rw, fmt.Sprintf("Failed to store value: %v", err), http.StatusInternalServerError)
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *grpcPort))
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+
+	server := dbrpc.Register(db)
+	go func() {
+		log.Println("gRPC server started on port", *grpcPort)
+		if err := server.Serve(lis); err != nil {
+			log.Fatalf("gRPC server stopped: %v", err)
+		}
+	}()
+}
+
+// startRESP lets Redis clients talk to the hash engine.
+func startRESP(engine datastore.Engine) {
+	db, ok := engine.(*datastore.Db)
+	if !ok {
+		log.Printf("Redis protocol is not supported by the %s engine", *engineName)
 		return
 	}
 
-	rw.WriteHeader(http.StatusCreated)
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *respPort))
+	if err != nil {
+		log.Fatalf("Failed to listen for Redis protocol: %v", err)
+	}
+
+	server := resp.NewServer(db)
+	go func() {
+		log.Println("Redis protocol server started on port", *respPort)
+		if err := server.Serve(lis); err != nil {
+			log.Fatalf("Redis protocol server stopped: %v", err)
+		}
+	}()
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+)
+
+// BackendStatus is what the admin API reports about a backend.
+type BackendStatus struct {
+	Addr     string `json:"addr"`
+	Weight   int    `json:"weight,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining"`
+	InFlight int    `json:"in_flight"`
+	// Circuit is the state of its circuit breaker: closed, open or
+	// half-open.
+	Circuit string `json:"circuit"`
+	// LastCheck and LastChange are the times of the last health check and
+	// of the last change of Healthy.
+	LastCheck  time.Time `json:"last_check,omitempty"`
+	LastChange time.Time `json:"last_change,omitempty"`
+}
+
+func (b *Balancer) Backends() []BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	list := make([]BackendStatus, 0, len(b.pool))
+	for _, server := range b.pool {
+		list = append(list, b.statusLocked(server))
+	}
+	return list
+}
+
+func (b *Balancer) statusLocked(server string) BackendStatus {
+	status := BackendStatus{
+		Addr:     server,
+		Weight:   b.weights[server],
+		Healthy:  b.healthyLocked(server),
+		Draining: b.draining[server],
+		InFlight: b.load.counts[server],
+		Circuit:  b.circuitLocked(server).String(),
+	}
+	if state := b.states[server]; state != nil {
+		status.LastCheck, status.LastChange = state.lastCheck, state.lastChange
+	}
+	return status
+}
+
+// Register adds a backend, or updates the weight of a known one and stops
+// draining it. It is checked right away and gets requests once healthy.
+// Registered backends last until the config is reloaded.
+func (b *Balancer) Register(backend lbconfig.Backend) (BackendStatus, bool) {
+	isFree := b.checker(backend.Addr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	created := !b.inPoolLocked(backend.Addr)
+	if created {
+		b.pool = append(b.pool, backend.Addr)
+	}
+	if b.weights == nil {
+		b.weights = make(map[string]int)
+	}
+	b.weights[backend.Addr] = backend.Weight
+	b.recordLocked(backend.Addr, isFree)
+	delete(b.draining, backend.Addr)
+	b.refreshLocked()
+
+	return b.statusLocked(backend.Addr), created
+}
+
+// Remove takes the backend out of the pool. Requests in flight on it finish.
+func (b *Balancer) Remove(server string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, s := range b.pool {
+		if s == server {
+			b.pool = append(b.pool[:i:i], b.pool[i+1:]...)
+			delete(b.weights, server)
+			delete(b.states, server)
+			delete(b.draining, server)
+			delete(b.breakers, server)
+			b.refreshLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// Drain stops sending new requests to the backend while those in flight
+// finish; InFlight of its status drops to zero once it is safe to stop.
+func (b *Balancer) Drain(server string) (BackendStatus, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.inPoolLocked(server) {
+		return BackendStatus{}, false
+	}
+	if b.draining == nil {
+		b.draining = make(map[string]bool)
+	}
+	b.draining[server] = true
+	b.refreshLocked()
+	return b.statusLocked(server), true
+}
+
+// adminHandler serves the backend management API:
+//
+//	GET    /admin/backends              list backends
+//	POST   /admin/backends              register {"addr": "...", "weight": n}
+//	DELETE /admin/backends/<addr>       remove a backend
+//	POST   /admin/backends/<addr>/drain stop new requests to a backend
+//	GET    /admin/events                latest health state changes
+func (b *Balancer) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/events", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", "GET")
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, http.StatusOK, b.Events())
+	})
+	mux.HandleFunc("/admin/backends", func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(rw, http.StatusOK, b.Backends())
+		case http.MethodPost:
+			var backend lbconfig.Backend
+			if err := json.NewDecoder(r.Body).Decode(&backend); err != nil {
+				http.Error(rw, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := backend.Validate(); err != nil {
+				http.Error(rw, fmt.Sprintf("Invalid backend: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			status, created := b.Register(backend)
+			code := http.StatusOK
+			if created {
+				code = http.StatusCreated
+			}
+			writeJSON(rw, code, status)
+		default:
+			rw.Header().Set("Allow", "GET, POST")
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/backends/", func(rw http.ResponseWriter, r *http.Request) {
+		server := strings.TrimPrefix(r.URL.Path, "/admin/backends/")
+
+		if addr, ok := strings.CutSuffix(server, "/drain"); ok {
+			if r.Method != http.MethodPost {
+				rw.Header().Set("Allow", "POST")
+				http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			status, ok := b.Drain(addr)
+			if !ok {
+				http.Error(rw, fmt.Sprintf("Backend %s not found", addr), http.StatusNotFound)
+				return
+			}
+			writeJSON(rw, http.StatusAccepted, status)
+			return
+		}
+
+		if r.Method != http.MethodDelete {
+			rw.Header().Set("Allow", "DELETE")
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !b.Remove(server) {
+			http.Error(rw, fmt.Sprintf("Backend %s not found", server), http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// adminAddr returns the address of the admin API. The API changes the
+// backends, so anything but a loopback host requires a token.
+func adminAddr(host string, port int, token string) (string, error) {
+	ip := net.ParseIP(host)
+	if token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("admin API on %q requires -admin-token", host)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// requireToken rejects requests without the bearer token, unless the token
+// is empty.
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
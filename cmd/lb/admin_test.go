@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(b *Balancer, method, path, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	b.adminHandler().ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rw
+}
+
+func listBackends(t *testing.T, b *Balancer) map[string]BackendStatus {
+	rw := adminRequest(b, http.MethodGet, "/admin/backends", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	var list []BackendStatus
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&list))
+	statuses := make(map[string]BackendStatus)
+	for _, s := range list {
+		statuses[s.Addr] = s
+	}
+	return statuses
+}
+
+func TestAdminAPI(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	var routed sync.Map
+	b := &Balancer{
+		strategy: &roundRobin{},
+		checker:  func(server string) bool { return server != "down:1" },
+		forward: func(dst string, rw http.ResponseWriter, r *http.Request) error {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-release
+			}
+			routed.Store(r.URL.Path, dst)
+			rw.WriteHeader(http.StatusOK)
+			return nil
+		},
+	}
+	config := lbconfig.Default()
+	config.Backends = []lbconfig.Backend{{Addr: "srv1:1"}}
+	b.Apply(config, nil)
+	b.Check()
+
+	// Health checks running all along must not disturb the changes.
+	stop := make(chan struct{})
+	var checks sync.WaitGroup
+	checks.Add(1)
+	go func() {
+		defer checks.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				b.Check()
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		checks.Wait()
+	}()
+
+	t.Run("Register", func(t *testing.T) {
+		rw := adminRequest(b, http.MethodPost, "/admin/backends", `{"addr": "srv2:1", "weight": 2}`)
+		assert.Equal(t, http.StatusCreated, rw.Code)
+
+		rw = adminRequest(b, http.MethodPost, "/admin/backends", `{"addr": "down:1"}`)
+		assert.Equal(t, http.StatusCreated, rw.Code)
+
+		rw = adminRequest(b, http.MethodPost, "/admin/backends", `{"addr": "srv2:1", "weight": 3}`)
+		assert.Equal(t, http.StatusOK, rw.Code, "registering again updates")
+
+		assert.Equal(t, http.StatusBadRequest, adminRequest(b, http.MethodPost, "/admin/backends", `{"addr": "http://srv3"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, adminRequest(b, http.MethodPost, "/admin/backends", `{"addr":`).Code)
+
+		statuses := listBackends(t, b)
+		assert.Len(t, statuses, 3)
+		status := statuses["srv2:1"]
+		assert.False(t, status.LastCheck.IsZero())
+		status.LastCheck, status.LastChange = time.Time{}, time.Time{}
+		assert.Equal(t, BackendStatus{Addr: "srv2:1", Weight: 3, Healthy: true, Circuit: "closed"}, status)
+		assert.False(t, statuses["down:1"].Healthy)
+	})
+
+	t.Run("Drain", func(t *testing.T) {
+		slow := make(chan int)
+		go func() { slow <- serve(b, "/slow") }()
+		<-started
+		var dst string
+		for addr, s := range listBackends(t, b) {
+			if s.InFlight == 1 {
+				dst = addr
+			}
+		}
+
+		rw := adminRequest(b, http.MethodPost, "/admin/backends/"+dst+"/drain", "")
+		assert.Equal(t, http.StatusAccepted, rw.Code)
+		var status BackendStatus
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&status))
+		assert.True(t, status.Draining)
+		assert.Equal(t, 1, status.InFlight, "the request in flight keeps going")
+
+		for i := 0; i < 10; i++ {
+			serve(b, "/fast")
+			other, _ := routed.Load("/fast")
+			assert.NotEqual(t, dst, other, "a draining backend got a new request")
+		}
+
+		close(release)
+		assert.Equal(t, http.StatusOK, <-slow)
+		assert.Equal(t, 0, listBackends(t, b)[dst].InFlight)
+
+		assert.Equal(t, http.StatusNotFound, adminRequest(b, http.MethodPost, "/admin/backends/unknown:1/drain", "").Code)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, adminRequest(b, http.MethodDelete, "/admin/backends/down:1", "").Code)
+		assert.Equal(t, http.StatusNotFound, adminRequest(b, http.MethodDelete, "/admin/backends/down:1", "").Code)
+		assert.NotContains(t, listBackends(t, b), "down:1")
+		assert.Equal(t, http.StatusMethodNotAllowed, adminRequest(b, http.MethodGet, "/admin/backends/srv1:1", "").Code)
+	})
+}
+
+func TestAdminAccess(t *testing.T) {
+	t.Run("Address", func(t *testing.T) {
+		addr, err := adminAddr("127.0.0.1", 8091, "")
+		assert.NoError(t, err)
+		assert.Equal(t, "127.0.0.1:8091", addr)
+
+		_, err = adminAddr("::1", 8091, "")
+		assert.NoError(t, err)
+		_, err = adminAddr("", 8091, "")
+		assert.Error(t, err, "all interfaces without a token")
+		_, err = adminAddr("10.0.0.1", 8091, "")
+		assert.Error(t, err, "a public interface without a token")
+
+		addr, err = adminAddr("", 8091, "secret")
+		assert.NoError(t, err)
+		assert.Equal(t, ":8091", addr)
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		b := &Balancer{strategy: &roundRobin{}}
+		b.Apply(lbconfig.Default(), nil)
+		handler := requireToken("secret", b.adminHandler())
+
+		for auth, code := range map[string]int{
+			"":              http.StatusUnauthorized,
+			"Bearer wrong":  http.StatusUnauthorized,
+			"secret":        http.StatusUnauthorized,
+			"Bearer secret": http.StatusOK,
+		} {
+			r := httptest.NewRequest(http.MethodGet, "/admin/backends", nil)
+			if auth != "" {
+				r.Header.Set("Authorization", auth)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, r)
+			assert.Equal(t, code, rw.Code, "Authorization: %q", auth)
+		}
+	})
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
-	"fmt"
-	"hash/fnv"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/VictorGOcking/lab-4/httptools"
+	"github.com/VictorGOcking/lab-4/lbconfig"
 	"github.com/VictorGOcking/lab-4/signal"
 )
 
@@ -18,13 +20,20 @@ var (
 	port       = flag.Int("port", 8090, "load balancer port")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	adminPort  = flag.Int("admin-port", 8091, "port of the admin API managing backends, 0 disables it")
+	adminHost  = flag.String("admin-host", "127.0.0.1", "interface of the admin API, any but a loopback one requires -admin-token")
+	adminToken = flag.String("admin-token", "", "bearer token the admin API requires in the Authorization header")
+	configPath = flag.String("config", "", "YAML or JSON file with the backends and settings, reloaded on SIGHUP or change; it replaces -strategy, -load-factor, -sticky-cookie and -timeout-sec")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	strategyName = flag.String("strategy", "hash:path", "balancing strategy: round-robin, least-connections, weighted, power-of-two, random, hash:path, hash:ip, hash:header:<name> or hash:cookie:<name>")
+	loadFactor   = flag.Float64("load-factor", defaultLoadFactor, "how many times the average load a server may take before hashed keys spill to the next one")
+	stickyCookie = flag.String("sticky-cookie", "", "name of the signed cookie keeping clients on the same server, sticky sessions are off if empty")
 )
 
-var (
-	timeout = time.Duration(*timeoutSec) * time.Second
-)
+// defaultLoadFactor lets a server take 25% over the average number of
+// requests in flight.
+const defaultLoadFactor = 1.25
 
 func scheme() string {
 	if *https {
@@ -33,126 +42,339 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false
+type Balancer struct {
+	pool   []string
+	active []string
+	// weights of the servers in pool for weighted strategies, 1 if missing.
+	weights map[string]int
+	// states are the health of the servers in pool according to the checks.
+	states map[string]*healthState
+	// events are the latest health state changes, oldest first.
+	events []HealthEvent
+	// monitors stop the check loops of the servers, once Analyse started
+	// them.
+	monitors map[string]chan struct{}
+	// draining servers get no new requests, those in flight finish.
+	draining map[string]bool
+	// breakers track the results of the requests forwarded to the servers.
+	breakers map[string]*breaker
+	// budget limits the retries of failed requests.
+	budget retryBudget
+	// secret signs the sticky cookies when the config has no secret.
+	secret []byte
+	// load counts the requests in flight on every server.
+	load inflight
+
+	// strategy picks among the active servers, consistent hashing of the
+	// path if it is not set.
+	strategy Strategy
+
+	checker func(server string) bool
+	forward func(dst string, rw http.ResponseWriter, r *http.Request) error
+
+	// settings are the current configuration, the defaults if nil.
+	settings *lbconfig.Config
+
+	// mu guards everything above but checker and forward.
+	mu sync.Mutex
+}
+
+func (b *Balancer) config() *lbconfig.Config {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.configLocked()
+}
+
+func (b *Balancer) configLocked() *lbconfig.Config {
+	if b.settings == nil {
+		b.settings = lbconfig.Default()
+	}
+	return b.settings
+}
+
+// Apply switches to the config. Requests in flight finish on the backends
+// and with the strategy they started with; the new pool is in use once it
+// has been checked. A nil strategy keeps the current one.
+func (b *Balancer) Apply(config *lbconfig.Config, strategy Strategy) {
+	weights := make(map[string]int)
+	for _, backend := range config.Backends {
+		weights[backend.Addr] = backend.Weight
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.settings = config
+	b.pool = config.Addrs()
+	b.weights = weights
+	if strategy != nil {
+		b.strategy = strategy
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+	for server := range b.states {
+		if _, ok := weights[server]; !ok {
+			delete(b.states, server)
+			delete(b.draining, server)
+			delete(b.breakers, server)
+		}
 	}
-	return true
+	b.refreshLocked()
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
+func (b *Balancer) Hash(url string) uint64 {
+	return hash(url)
+}
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
+// Check runs the health checks of all servers at once and records the
+// results.
+func (b *Balancer) Check() {
+	b.mu.Lock()
+	pool := append([]string(nil), b.pool...)
+	b.mu.Unlock()
+
+	results := make([]bool, len(pool))
+	var wg sync.WaitGroup
+	for i, server := range pool {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			results[i] = b.checker(server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, server := range pool {
+		// Servers removed during the check are not brought back.
+		if b.inPoolLocked(server) {
+			b.recordLocked(server, results[i])
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+	}
+	b.refreshLocked()
+}
+
+func (b *Balancer) inPoolLocked(server string) bool {
+	for _, s := range b.pool {
+		if s == server {
+			return true
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+	}
+	return false
+}
+
+// refreshLocked makes the healthy servers that are neither draining nor
+// ejected by their circuit breaker active and hands them to the strategy.
+func (b *Balancer) refreshLocked() {
+	active := []string{}
+	var backends []Backend
+	for _, server := range b.pool {
+		if b.healthyLocked(server) && !b.draining[server] && b.circuitLocked(server) != open {
+			active = append(active, server)
+			backends = append(backends, Backend{Addr: server, Weight: b.weights[server]})
 		}
-		return nil
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		return err
 	}
+	b.active = active
+	b.strategyLocked().Update(backends)
+	b.syncMonitorsLocked()
 }
 
-type Balancer struct {
-	pool   []string
-	active []string
+func (b *Balancer) getStrategy() Strategy {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.strategyLocked()
+}
 
-	checker func(server string) bool
-	forward func(dst string, rw http.ResponseWriter, r *http.Request) error
+func (b *Balancer) strategyLocked() Strategy {
+	if b.strategy == nil {
+		b.strategy = newConsistentHash(pathKey, defaultLoadFactor)
+	}
+	return b.strategy
 }
 
-func (b *Balancer) Hash(url string) uint64 {
-	hasher := fnv.New64()
-	_, _ = hasher.Write([]byte(url))
-	return hasher.Sum64()
+// ServeHTTP forwards the request to a backend picked by the strategy, or
+// named by its sticky cookie. Idempotent requests that fail are retried on
+// other backends, as long as the retry budget allows.
+func (b *Balancer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	config := b.config()
+	attempts := 1
+	if idempotent(r.Method) && config.Retries.Attempts > 1 {
+		body, ok := bufferBody(r, config.Retries.MaxBodySize)
+		if ok {
+			attempts = config.Retries.Attempts
+		}
+		if body != nil {
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.budget.deposit(config.Retries.Budget)
+	b.mu.Unlock()
+
+	sticky, isSticky := b.stickyServer(r, config.Sticky)
+	strategy := b.getStrategy()
+	tried := make(map[string]bool)
+	for attempt := 1; ; attempt++ {
+		server, picked := sticky, false
+		if attempt > 1 || !isSticky {
+			var ok bool
+			if server, ok = strategy.Pick(r, tried); !ok {
+				log.Println("No free servers available")
+				status := http.StatusServiceUnavailable
+				if attempt > 1 {
+					status = http.StatusBadGateway
+				}
+				rw.WriteHeader(status)
+				return
+			}
+			picked = true
+		}
+		tried[server] = true
+
+		var cookie *http.Cookie
+		if config.Sticky.Cookie != "" && (!isSticky || server != sticky) {
+			cookie = b.stickyCookie(server, config.Sticky, r)
+		}
+		if *traceEnabled {
+			rw.Header().Set("lb-attempts", strconv.Itoa(attempt))
+		}
+		canRetry := attempt < attempts && b.mayRetry(len(tried))
+		done := b.attempt(server, rw, r, canRetry, cookie, config)
+		if picked {
+			strategy.Done(server)
+		}
+		if done {
+			return
+		}
+
+		b.mu.Lock()
+		b.budget.withdraw()
+		b.mu.Unlock()
+		log.Printf("Retrying %s %s on another server", r.Method, r.URL)
+	}
 }
 
-func (b *Balancer) Check() {
-	b.active = []string{}
+// mayRetry reports whether the budget allows a retry and there is an
+// active server left to try.
+func (b *Balancer) mayRetry(tried int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.budget.available() && tried < len(b.active)
+}
 
-	for _, server := range b.pool {
-		isFree := b.checker(server)
-		if isFree {
-			b.active = append(b.active, server)
-		} else {
-			fmt.Printf("Server %s is unavailable", server)
+// attempt forwards the request to the server, setting the cookie on its
+// response if there is one. It returns false, having written nothing, when
+// the attempt failed and may be retried.
+func (b *Balancer) attempt(server string, rw http.ResponseWriter, r *http.Request, canRetry bool, cookie *http.Cookie, config *lbconfig.Config) bool {
+	b.mu.Lock()
+	b.load.add(server)
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.load.remove(server)
+		b.mu.Unlock()
+	}()
+
+	// The timeout bounds the wait for the response headers, a streamed body
+	// takes as long as the server sends it.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := time.AfterFunc(config.Timeout.Duration, cancel)
+	defer timer.Stop()
+
+	fwdRequest := r.WithContext(ctx)
+	if r.GetBody != nil {
+		fwdRequest.Body, _ = r.GetBody()
+	}
+
+	var retry func(status int) bool
+	if canRetry {
+		retry = func(status int) bool {
+			for _, s := range config.Retries.OnStatus {
+				if s == status {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	aw := newAttemptWriter(rw, retry)
+	aw.started = func() { timer.Stop() }
+	if cookie != nil {
+		http.SetCookie(aw, cookie)
+	}
+	err := b.forward(server, aw, fwdRequest)
+
+	// Requests cancelled by the client say nothing about the server and
+	// are not worth retrying.
+	if r.Context().Err() != nil {
+		canRetry = false
+	} else {
+		b.mu.Lock()
+		b.reportLocked(server, err == nil && aw.status < http.StatusInternalServerError)
+		b.mu.Unlock()
+	}
+
+	if err != nil {
+		log.Printf("Failed to get response from %s: %s", server, err)
+		if canRetry {
+			return false
 		}
+		rw.WriteHeader(http.StatusBadGateway)
+		return true
 	}
+	return !aw.dropped
 }
 
+// Analyse checks all servers and then keeps checking every one of them on
+// its own schedule.
 func (b *Balancer) Analyse() {
 	b.Check()
 
-	go func() {
-		for range time.Tick(10 * time.Second) {
-			b.Check()
-		}
-	}()
+	b.mu.Lock()
+	b.monitors = make(map[string]chan struct{})
+	b.syncMonitorsLocked()
+	b.mu.Unlock()
 }
 
 func (b *Balancer) Run() {
 	flag.Parse()
 
+	config, strategy, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	admin, err := adminAddr(*adminHost, *adminPort, *adminToken)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b.Apply(config, strategy)
 	b.Analyse()
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		if len(b.active) == 0 {
-			log.Println("No free servers available")
-			rw.WriteHeader(http.StatusBadGateway)
-			return
-		}
+	if *configPath != "" {
+		lbconfig.Watch(*configPath, configPollInterval, b.reload)
+	}
 
-		serverIndex := b.Hash(r.URL.Path) % uint64(len(b.pool))
-		err := b.forward(b.pool[serverIndex], rw, r)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}))
+	frontend := httptools.CreateServer(*port, b)
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
+	if *adminPort != 0 {
+		httptools.CreateServerOn(admin, requireToken(*adminToken, b.adminHandler())).Start()
+	}
 	signal.WaitForTerminationSignal()
 }
 
 func main() {
-	balancer := Balancer{
-		pool: []string{
-			"server1:8080",
-			"server2:8080",
-			"server3:8080",
-		},
+	balancer := &Balancer{
 		active:  []string{},
-		checker: health,
 		forward: forward,
 	}
+	balancer.checker = balancer.health
 
 	balancer.Run()
 }
@@ -5,7 +5,11 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -81,3 +85,140 @@ func TestBalancer(t *testing.T) {
 	assert.Equal(t, []string{"srv1", "srv3", "srv4"}, b.active)
 	assert.Contains(t, output, "Server srv2 is unavailable")
 }
+
+func recordingBalancer(pool []string, down map[string]bool) (*Balancer, map[string]string) {
+	routed := make(map[string]string)
+	b := &Balancer{
+		pool: pool,
+		checker: func(dst string) bool {
+			return !down[dst]
+		},
+		forward: func(dst string, rw http.ResponseWriter, r *http.Request) error {
+			routed[r.URL.Path] = dst
+			rw.WriteHeader(http.StatusOK)
+			return nil
+		},
+	}
+	captureOutput(b.Check)
+	return b, routed
+}
+
+// checkUntilSettled runs enough checks for the servers to reach their
+// state.
+func checkUntilSettled(b *Balancer) {
+	for i := 0; i < b.config().HealthCheck.UnhealthyThreshold; i++ {
+		captureOutput(b.Check)
+	}
+}
+
+func serve(b *Balancer, path string) int {
+	rw := httptest.NewRecorder()
+	b.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+	return rw.Code
+}
+
+func TestBalancerHealthyOnly(t *testing.T) {
+	down := map[string]bool{"srv2": true}
+	b, routed := recordingBalancer([]string{"srv1", "srv2", "srv3", "srv4"}, down)
+
+	for i := 0; i < 500; i++ {
+		assert.Equal(t, http.StatusOK, serve(b, fmt.Sprintf("/path/%d", i)))
+	}
+	assert.Len(t, routed, 500)
+	for path, dst := range routed {
+		assert.NotEqual(t, "srv2", dst, path)
+	}
+
+	down["srv1"], down["srv3"], down["srv4"] = true, true, true
+	checkUntilSettled(b)
+	assert.Equal(t, http.StatusServiceUnavailable, serve(b, "/path/0"))
+}
+
+func TestBalancerConsistentHashing(t *testing.T) {
+	down := make(map[string]bool)
+	b, routed := recordingBalancer([]string{"srv1", "srv2", "srv3", "srv4"}, down)
+
+	const paths = 4000
+	for i := 0; i < paths; i++ {
+		serve(b, fmt.Sprintf("/path/%d", i))
+	}
+
+	before := make(map[string]string)
+	shares := make(map[string]int)
+	for path, dst := range routed {
+		before[path] = dst
+		shares[dst]++
+	}
+	for server, n := range shares {
+		assert.InDelta(t, paths/4, n, paths/10, "share of %s", server)
+	}
+
+	down["srv3"] = true
+	checkUntilSettled(b)
+	for i := 0; i < paths; i++ {
+		serve(b, fmt.Sprintf("/path/%d", i))
+	}
+
+	for path, dst := range routed {
+		if before[path] == "srv3" {
+			assert.NotEqual(t, "srv3", dst, path)
+		} else {
+			assert.Equal(t, before[path], dst, "%s moved off a healthy server", path)
+		}
+	}
+}
+
+func TestBalancerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.yaml")
+	writeConfig := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(old string) { *configPath = old }(*configPath)
+	*configPath = path
+
+	started, release := make(chan struct{}), make(chan struct{})
+	var routed sync.Map
+	b := &Balancer{
+		checker: func(string) bool { return true },
+		forward: func(dst string, rw http.ResponseWriter, r *http.Request) error {
+			if r.URL.Path == "/slow" {
+				close(started)
+				<-release
+			}
+			routed.Store(r.URL.Path, dst)
+			rw.WriteHeader(http.StatusOK)
+			return nil
+		},
+	}
+
+	writeConfig("strategy: round-robin\nbackends:\n  - addr: srv1\n  - addr: srv2\n")
+	b.reload()
+	assert.Equal(t, []string{"srv1", "srv2"}, b.active)
+
+	// A request in flight during a reload finishes on its backend.
+	slow := make(chan int)
+	go func() { slow <- serve(b, "/slow") }()
+	<-started
+
+	writeConfig("strategy: weighted\nbackends:\n  - addr: srv3\n    weight: 2\n")
+	b.reload()
+	assert.Equal(t, []string{"srv3"}, b.active)
+	assert.Equal(t, map[string]int{"srv3": 2}, b.weights)
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-slow)
+	dst, _ := routed.Load("/slow")
+	assert.Contains(t, []string{"srv1", "srv2"}, dst)
+
+	assert.Equal(t, http.StatusOK, serve(b, "/fast"))
+	dst, _ = routed.Load("/fast")
+	assert.Equal(t, "srv3", dst)
+
+	// An invalid file leaves the current config in place.
+	writeConfig("strategy: fastest\nbackends:\n  - addr: srv4\n")
+	b.reload()
+	assert.Equal(t, []string{"srv3"}, b.active)
+	assert.Equal(t, "weighted", b.config().Strategy)
+}
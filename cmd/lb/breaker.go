@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// circuit is the state of the circuit breaker of a backend.
+type circuit int
+
+const (
+	// closed backends get requests, their failures in a row are counted.
+	closed circuit = iota
+	// open backends are ejected until their backoff ends.
+	open
+	// halfOpen backends get requests again; the first result closes the
+	// circuit or opens it for twice as long.
+	halfOpen
+)
+
+func (c circuit) String() string {
+	switch c {
+	case open:
+		return "open"
+	case halfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type breaker struct {
+	state    circuit
+	failures int
+	backoff  time.Duration
+}
+
+func (b *Balancer) circuitLocked(server string) circuit {
+	if br := b.breakers[server]; br != nil {
+		return br.state
+	}
+	return closed
+}
+
+// reportLocked counts the result of a request forwarded to the server.
+// Results of requests that started before the circuit opened are ignored.
+func (b *Balancer) reportLocked(server string, ok bool) {
+	if !b.inPoolLocked(server) {
+		return
+	}
+	if b.breakers == nil {
+		b.breakers = make(map[string]*breaker)
+	}
+	br := b.breakers[server]
+	if br == nil {
+		br = &breaker{}
+		b.breakers[server] = br
+	}
+	settings := b.configLocked().CircuitBreaker
+
+	switch {
+	case br.state == open:
+	case ok && br.state == halfOpen:
+		log.Printf("Circuit of %s is closed", server)
+		br.state, br.failures, br.backoff = closed, 0, 0
+	case ok:
+		br.failures = 0
+	case br.state == halfOpen:
+		backoff := 2 * br.backoff
+		if backoff > settings.MaxBackoff.Duration {
+			backoff = settings.MaxBackoff.Duration
+		}
+		b.openLocked(server, br, backoff)
+	default:
+		if br.failures++; br.failures >= settings.Failures {
+			b.openLocked(server, br, settings.Backoff.Duration)
+		}
+	}
+}
+
+// openLocked ejects the server for the backoff, after which it is given
+// another chance.
+func (b *Balancer) openLocked(server string, br *breaker, backoff time.Duration) {
+	log.Printf("Circuit of %s is open for %s", server, backoff)
+	br.state, br.failures, br.backoff = open, 0, backoff
+	b.refreshLocked()
+
+	time.AfterFunc(backoff, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		// The server may have been removed, or removed and added again.
+		if b.breakers[server] != br || br.state != open {
+			return
+		}
+		log.Printf("Circuit of %s is half-open", server)
+		br.state = halfOpen
+		b.refreshLocked()
+	})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+// breakerBalancer has a single server that answers with the status in
+// result, or fails to answer if it is zero.
+func breakerBalancer(result *atomic.Int32) *Balancer {
+	b := &Balancer{
+		strategy: &roundRobin{},
+		checker:  func(string) bool { return true },
+		forward: func(dst string, rw http.ResponseWriter, r *http.Request) error {
+			status := int(result.Load())
+			if status == 0 {
+				return errors.New("connection refused")
+			}
+			rw.WriteHeader(status)
+			return nil
+		},
+	}
+	config := lbconfig.Default()
+	config.Backends = []lbconfig.Backend{{Addr: "srv1:1"}}
+	config.CircuitBreaker = lbconfig.CircuitBreaker{
+		Failures:   2,
+		Backoff:    lbconfig.Duration{Duration: 20 * time.Millisecond},
+		MaxBackoff: lbconfig.Duration{Duration: 30 * time.Millisecond},
+	}
+	b.Apply(config, nil)
+	b.Check()
+	return b
+}
+
+func waitForCircuit(t *testing.T, b *Balancer, state string) {
+	deadline := time.Now().Add(time.Second)
+	for b.Backends()[0].Circuit != state && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, state, b.Backends()[0].Circuit)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("Connection errors", func(t *testing.T) {
+		var result atomic.Int32
+		b := breakerBalancer(&result)
+
+		assert.Equal(t, http.StatusBadGateway, serve(b, "/"))
+		assert.Equal(t, "closed", b.Backends()[0].Circuit)
+		assert.Equal(t, http.StatusBadGateway, serve(b, "/"))
+		assert.Equal(t, "open", b.Backends()[0].Circuit)
+		assert.Equal(t, http.StatusServiceUnavailable, serve(b, "/"), "the server is ejected")
+
+		// A failure when half-open ejects it again.
+		waitForCircuit(t, b, "half-open")
+		assert.Equal(t, http.StatusBadGateway, serve(b, "/"))
+		assert.Equal(t, "open", b.Backends()[0].Circuit)
+
+		result.Store(http.StatusOK)
+		waitForCircuit(t, b, "half-open")
+		assert.Equal(t, http.StatusOK, serve(b, "/"))
+		assert.Equal(t, "closed", b.Backends()[0].Circuit)
+	})
+
+	t.Run("Server errors", func(t *testing.T) {
+		var result atomic.Int32
+		result.Store(http.StatusInternalServerError)
+		b := breakerBalancer(&result)
+
+		assert.Equal(t, http.StatusInternalServerError, serve(b, "/"))
+		assert.Equal(t, http.StatusInternalServerError, serve(b, "/"))
+		assert.Equal(t, http.StatusServiceUnavailable, serve(b, "/"))
+	})
+
+	t.Run("Successes reset the count", func(t *testing.T) {
+		var result atomic.Int32
+		b := breakerBalancer(&result)
+
+		for i := 0; i < 3; i++ {
+			result.Store(0)
+			assert.Equal(t, http.StatusBadGateway, serve(b, "/"))
+			result.Store(http.StatusNotFound)
+			assert.Equal(t, http.StatusNotFound, serve(b, "/"))
+		}
+		assert.Equal(t, "closed", b.Backends()[0].Circuit)
+	})
+
+	t.Run("Cancelled requests", func(t *testing.T) {
+		var result atomic.Int32
+		b := breakerBalancer(&result)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		for i := 0; i < 3; i++ {
+			rw := httptest.NewRecorder()
+			b.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		}
+		assert.Equal(t, "closed", b.Backends()[0].Circuit)
+	})
+}
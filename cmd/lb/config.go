@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 2 * time.Second
+
+// loadConfig reads the -config file, or makes the config of the flags
+// without one, along with its strategy.
+func loadConfig() (*lbconfig.Config, Strategy, error) {
+	config := lbconfig.Default()
+	if *configPath != "" {
+		var err error
+		if config, err = lbconfig.Load(*configPath); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		config.Strategy = *strategyName
+		config.LoadFactor = *loadFactor
+		config.Sticky.Cookie = *stickyCookie
+		config.Timeout = lbconfig.Duration{Duration: time.Duration(*timeoutSec) * time.Second}
+		if err := config.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	strategy, err := newStrategy(config.Strategy, config.LoadFactor)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %v", err)
+	}
+	return config, strategy, nil
+}
+
+// reload applies the config file again. An invalid file is reported and the
+// current config stays. The strategy is kept when its settings have not
+// changed, so it does not lose track of the requests in flight.
+func (b *Balancer) reload() {
+	config, strategy, err := loadConfig()
+	if err != nil {
+		log.Printf("Keeping the current config: %v", err)
+		return
+	}
+
+	current := b.config()
+	if config.Strategy == current.Strategy && config.LoadFactor == current.LoadFactor {
+		strategy = nil
+	}
+
+	b.Apply(config, strategy)
+	b.Check()
+	log.Printf("Reloaded config with %d backends, strategy %s", len(config.Backends), config.Strategy)
+}
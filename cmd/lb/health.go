@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxHealthEvents is how many state changes the admin API reports.
+const maxHealthEvents = 100
+
+type healthState struct {
+	healthy bool
+	// streak counts the checks in a row that disagree with healthy.
+	streak     int
+	lastCheck  time.Time
+	lastChange time.Time
+}
+
+// HealthEvent records a server becoming healthy or unhealthy.
+type HealthEvent struct {
+	Time    time.Time `json:"time"`
+	Addr    string    `json:"addr"`
+	Healthy bool      `json:"healthy"`
+	// Checks is the number of checks in a row that led to the change.
+	Checks int `json:"checks"`
+}
+
+// health checks the server with the health check of its config: a response
+// with the expected status, and body if one is expected, within the timeout.
+func (b *Balancer) health(dst string) bool {
+	check := b.config().HealthCheckOf(dst)
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout.Duration)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s://%s%s", scheme(), dst, check.Path), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	expected := check.ExpectStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if resp.StatusCode != expected {
+		return false
+	}
+	if check.ExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if err != nil || !strings.Contains(string(body), check.ExpectBody) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Balancer) healthyLocked(server string) bool {
+	state := b.states[server]
+	return state != nil && state.healthy
+}
+
+// recordLocked counts the result of a check of the server. The first check
+// decides the state at once, after that it changes when the thresholds of
+// results in a row are reached.
+func (b *Balancer) recordLocked(server string, isFree bool) {
+	if !isFree {
+		fmt.Printf("Server %s is unavailable", server)
+	}
+
+	now := time.Now()
+	if b.states == nil {
+		b.states = make(map[string]*healthState)
+	}
+	state, ok := b.states[server]
+	if !ok {
+		b.states[server] = &healthState{healthy: isFree, lastCheck: now, lastChange: now}
+		b.eventLocked(HealthEvent{Time: now, Addr: server, Healthy: isFree, Checks: 1})
+		return
+	}
+
+	state.lastCheck = now
+	if state.healthy == isFree {
+		state.streak = 0
+		return
+	}
+
+	state.streak++
+	check := b.configLocked().HealthCheckOf(server)
+	threshold := check.UnhealthyThreshold
+	if isFree {
+		threshold = check.HealthyThreshold
+	}
+	if state.streak < threshold {
+		return
+	}
+
+	b.eventLocked(HealthEvent{Time: now, Addr: server, Healthy: isFree, Checks: state.streak})
+	state.healthy, state.streak, state.lastChange = isFree, 0, now
+}
+
+func (b *Balancer) eventLocked(event HealthEvent) {
+	state := "unhealthy"
+	if event.Healthy {
+		state = "healthy"
+	}
+	log.Printf("Backend %s is %s after %d checks", event.Addr, state, event.Checks)
+
+	b.events = append(b.events, event)
+	if len(b.events) > maxHealthEvents {
+		b.events = append([]HealthEvent(nil), b.events[len(b.events)-maxHealthEvents:]...)
+	}
+}
+
+// Events returns the latest health state changes, oldest first.
+func (b *Balancer) Events() []HealthEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]HealthEvent{}, b.events...)
+}
+
+// syncMonitorsLocked starts a check loop for every server in the pool
+// without one and stops those of the servers that left it.
+func (b *Balancer) syncMonitorsLocked() {
+	if b.monitors == nil {
+		return
+	}
+
+	for server, stop := range b.monitors {
+		if !b.inPoolLocked(server) {
+			close(stop)
+			delete(b.monitors, server)
+		}
+	}
+	for _, server := range b.pool {
+		if _, ok := b.monitors[server]; !ok {
+			stop := make(chan struct{})
+			b.monitors[server] = stop
+			go b.monitor(server, stop)
+		}
+	}
+}
+
+// monitor checks the server every interval of its health check until
+// stopped. The first check comes at a random point of the first interval
+// and the next ones are jittered, so that the checks of all servers do not
+// run at the same moment.
+func (b *Balancer) monitor(server string, stop <-chan struct{}) {
+	interval := b.config().HealthCheckOf(server).Interval.Duration
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(interval)) + 1))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		isFree := b.checker(server)
+
+		b.mu.Lock()
+		if b.inPoolLocked(server) {
+			b.recordLocked(server, isFree)
+			b.refreshLocked()
+		}
+		interval = b.configLocked().HealthCheckOf(server).Interval.Duration
+		b.mu.Unlock()
+
+		timer.Reset(jitter(interval))
+	}
+}
+
+// jitter spreads the interval by 10% either way.
+func jitter(d time.Duration) time.Duration {
+	return d - d/10 + time.Duration(rand.Int63n(int64(d/5)+1))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthThresholds(t *testing.T) {
+	down := make(map[string]bool)
+	b := &Balancer{checker: func(server string) bool { return !down[server] }}
+	config := lbconfig.Default()
+	config.HealthCheck.HealthyThreshold, config.HealthCheck.UnhealthyThreshold = 2, 3
+	config.Backends = []lbconfig.Backend{
+		{Addr: "srv1:1"},
+		{Addr: "srv2:1", HealthCheck: &lbconfig.HealthCheck{UnhealthyThreshold: 1}},
+	}
+	b.Apply(config, nil)
+
+	captureOutput(b.Check)
+	assert.Equal(t, []string{"srv1:1", "srv2:1"}, b.active, "the first check decides")
+
+	down["srv1:1"], down["srv2:1"] = true, true
+	captureOutput(b.Check)
+	assert.Equal(t, []string{"srv1:1"}, b.active, "srv2:1 goes down after a single failure")
+	captureOutput(b.Check)
+	assert.Equal(t, []string{"srv1:1"}, b.active)
+
+	// A success in between starts the count over.
+	down["srv1:1"] = false
+	captureOutput(b.Check)
+	down["srv1:1"] = true
+	captureOutput(b.Check)
+	captureOutput(b.Check)
+	assert.Equal(t, []string{"srv1:1"}, b.active)
+	captureOutput(b.Check)
+	assert.Empty(t, b.active)
+
+	down["srv1:1"] = false
+	captureOutput(b.Check)
+	assert.Empty(t, b.active)
+	captureOutput(b.Check)
+	assert.Equal(t, []string{"srv1:1"}, b.active)
+
+	events := b.Events()
+	assert.Len(t, events, 5)
+	last := events[len(events)-1]
+	assert.Equal(t, "srv1:1", last.Addr)
+	assert.True(t, last.Healthy)
+	assert.Equal(t, 2, last.Checks)
+
+	rw := adminRequest(b, http.MethodGet, "/admin/events", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"addr":"srv2:1","healthy":false,"checks":1`)
+}
+
+func TestHealthCheck(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			_, _ = rw.Write([]byte("OK"))
+		case "/warming":
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+
+	for _, tc := range []struct {
+		check   lbconfig.HealthCheck
+		healthy bool
+	}{
+		{lbconfig.HealthCheck{}, true},
+		{lbconfig.HealthCheck{ExpectBody: "OK"}, true},
+		{lbconfig.HealthCheck{ExpectBody: "ready"}, false},
+		{lbconfig.HealthCheck{ExpectStatus: http.StatusNoContent}, false},
+		{lbconfig.HealthCheck{Path: "/warming"}, false},
+		{lbconfig.HealthCheck{Path: "/warming", ExpectStatus: http.StatusServiceUnavailable}, true},
+		{lbconfig.HealthCheck{Path: "/slow", Timeout: lbconfig.Duration{Duration: 50 * time.Millisecond}}, false},
+	} {
+		config := lbconfig.Default()
+		check := tc.check
+		config.Backends = []lbconfig.Backend{{Addr: addr, HealthCheck: &check}}
+		b := &Balancer{settings: config}
+		assert.Equal(t, tc.healthy, b.health(addr), "%+v", tc.check)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(10 * time.Second)
+		assert.True(t, d >= 9*time.Second && d <= 11*time.Second, d)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// transport sends the forwarded requests. Unlike a client it leaves
+// redirects to the client.
+var transport http.RoundTripper = http.DefaultTransport
+
+// hopHeaders concern a single connection and are not forwarded, along with
+// the headers listed in Connection (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeType returns the protocol the request asks to switch to, such as
+// websocket, if any.
+func upgradeType(h http.Header) string {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if strings.EqualFold(textproto.TrimString(name), "Upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// forward sends the request to dst, within the deadline of its context, and
+// streams the response back. Once a backend agrees to switch protocols, the
+// connections are spliced until either side closes. It writes nothing when
+// it fails to get a response.
+func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
+	fwdRequest := r.Clone(r.Context())
+	fwdRequest.RequestURI = ""
+	fwdRequest.URL.Host = dst
+	fwdRequest.URL.Scheme = scheme()
+	fwdRequest.Host = dst
+	fwdRequest.Close = false
+	if r.ContentLength == 0 {
+		fwdRequest.Body = nil
+	}
+
+	removeHopHeaders(fwdRequest.Header)
+	upgrade := upgradeType(r.Header)
+	if upgrade != "" {
+		fwdRequest.Header.Set("Connection", "Upgrade")
+		fwdRequest.Header.Set("Upgrade", upgrade)
+	}
+	// Backends may answer with trailers if the client takes them.
+	if acceptsTrailers(r.Header) {
+		fwdRequest.Header.Set("Te", "trailers")
+	}
+	if _, ok := fwdRequest.Header["User-Agent"]; !ok {
+		// Not the default of the Go client.
+		fwdRequest.Header.Set("User-Agent", "")
+	}
+	setForwarded(fwdRequest.Header, r)
+
+	resp, err := transport.RoundTrip(fwdRequest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return switchProtocols(dst, rw, upgrade, resp)
+	}
+
+	removeHopHeaders(resp.Header)
+	for k, values := range resp.Header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	// Trailers are announced before the body and sent after it.
+	announced := make([]string, 0, len(resp.Trailer))
+	for k := range resp.Trailer {
+		announced = append(announced, k)
+	}
+	if len(announced) > 0 {
+		rw.Header().Add("Trailer", strings.Join(announced, ", "))
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst)
+	}
+
+	log.Println("fwd", resp.StatusCode, resp.Request.URL)
+	rw.WriteHeader(resp.StatusCode)
+
+	if err := copyBody(rw, resp.Body, streaming(resp)); err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return nil
+	}
+	for k, values := range resp.Trailer {
+		if !contains(announced, k) {
+			k = http.TrailerPrefix + k
+		}
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	return nil
+}
+
+// switchProtocols passes the 101 response of the backend to the client over
+// the hijacked client connection and splices the two connections.
+func switchProtocols(dst string, rw http.ResponseWriter, upgrade string, resp *http.Response) error {
+	if got := resp.Header.Get("Upgrade"); upgrade == "" || !strings.EqualFold(got, upgrade) {
+		return fmt.Errorf("backend switched to %q instead of %q", got, upgrade)
+	}
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return fmt.Errorf("backend connection of type %T is not writable", resp.Body)
+	}
+
+	client, buffered, err := http.NewResponseController(rw).Hijack()
+	if err != nil {
+		return fmt.Errorf("cannot take over the client connection: %w", err)
+	}
+	defer client.Close()
+	// The session must not inherit the deadlines the server set for the
+	// request, whatever net/http leaves on the hijacked connection.
+	if err := client.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("cannot clear the deadlines of the client connection: %w", err)
+	}
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", upgrade)
+	if *traceEnabled {
+		resp.Header.Set("lb-from", dst)
+	}
+	resp.Body = nil
+	if err := resp.Write(buffered); err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		log.Printf("Failed to write response: %s", err)
+		return nil
+	}
+
+	log.Println("fwd", resp.StatusCode, resp.Request.URL, upgrade)
+	splice(client, buffered.Reader, backend)
+	return nil
+}
+
+// splice copies both ways between the connections until either side is
+// done, then closes them. Data the client sent along with the handshake is
+// in buffered.
+func splice(client net.Conn, buffered io.Reader, backend io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(backend, buffered)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+
+	<-done
+	_ = client.Close()
+	_ = backend.Close()
+	<-done
+}
+
+func acceptsTrailers(h http.Header) bool {
+	for _, field := range h.Values("Te") {
+		for _, coding := range strings.Split(field, ",") {
+			coding, _, _ = strings.Cut(coding, ";")
+			if strings.EqualFold(textproto.TrimString(coding), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwarded tells the backend about the client of the request with the
+// X-Forwarded-* headers and with Forwarded (RFC 7239), appending to those
+// of the proxies before us.
+func setForwarded(h http.Header, r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	client := clientIP(r)
+
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		h.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+client)
+	} else {
+		h.Set("X-Forwarded-For", client)
+	}
+	h.Set("X-Forwarded-Proto", proto)
+	h.Set("X-Forwarded-Host", r.Host)
+
+	node := client
+	if ip := net.ParseIP(client); ip != nil && ip.To4() == nil {
+		node = `"[` + client + `]"`
+	}
+	element := "for=" + node + ";host=" + quoteForwarded(r.Host) + ";proto=" + proto
+	if prior := h.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	h.Set("Forwarded", element)
+}
+
+// quoteForwarded quotes values that are not tokens, such as host:port.
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\" ") {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
+
+// streaming responses, such as server-sent events or those without a known
+// length, are flushed as they come.
+func streaming(resp *http.Response) bool {
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	return resp.ContentLength == -1 || strings.TrimSpace(mediaType) == "text/event-stream"
+}
+
+// copyBody copies the response body to the client. A streamed body takes as
+// long as the backend sends it, so the write timeout of the frontend server
+// is lifted for it.
+func copyBody(rw http.ResponseWriter, body io.Reader, flush bool) error {
+	if !flush {
+		_, err := io.Copy(rw, body)
+		return err
+	}
+
+	rc := http.NewResponseController(rw)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := rw.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func backendAddr(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestForwardHeaders(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		rw.Header().Set("Connection", "X-Session")
+		rw.Header().Set("X-Session", "secret")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		rw.Header().Set("Location", "/elsewhere")
+		rw.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	r.RemoteAddr = "10.0.0.7:5123"
+	r.Header.Set("Connection", "X-Hop, Keep-Alive")
+	r.Header.Set("X-Hop", "1")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.Header.Set("Forwarded", "for=1.2.3.4")
+	r.Header.Set("X-Kept", "yes")
+
+	rw := httptest.NewRecorder()
+	assert.NoError(t, forward(backendAddr(backend), rw, r))
+
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Authorization"} {
+		assert.Empty(t, got.Get(name), "%s was forwarded", name)
+	}
+	assert.Equal(t, "yes", got.Get("X-Kept"))
+	assert.Equal(t, "1.2.3.4, 10.0.0.7", got.Get("X-Forwarded-For"))
+	assert.Equal(t, "http", got.Get("X-Forwarded-Proto"))
+	assert.Equal(t, "example.com", got.Get("X-Forwarded-Host"))
+	assert.Equal(t, "for=1.2.3.4, for=10.0.0.7;host=example.com;proto=http", got.Get("Forwarded"))
+
+	assert.Equal(t, http.StatusFound, rw.Code, "redirects are left to the client")
+	assert.Equal(t, "/elsewhere", rw.Header().Get("Location"))
+	for _, name := range []string{"Connection", "X-Session", "Keep-Alive"} {
+		assert.Empty(t, rw.Header().Get(name), "%s was passed back", name)
+	}
+}
+
+func TestSetForwardedIPv6(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://lb:8090/", nil)
+	r.RemoteAddr = "[2001:db8::1]:5123"
+	h := make(http.Header)
+	setForwarded(h, r)
+	assert.Equal(t, "2001:db8::1", h.Get("X-Forwarded-For"))
+	assert.Equal(t, `for="[2001:db8::1]";host="lb:8090";proto=http`, h.Get("Forwarded"))
+}
+
+func TestForwardTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte("body"))
+		rw.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	rw := httptest.NewRecorder()
+	assert.NoError(t, forward(backendAddr(backend), rw, httptest.NewRequest(http.MethodGet, "/", nil)))
+
+	resp := rw.Result()
+	assert.Equal(t, "body", rw.Body.String())
+	assert.Equal(t, "abc", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestBalancerTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte("body"))
+		rw.Header().Set("X-Checksum", "abc")
+	}))
+	defer backend.Close()
+
+	b := &Balancer{
+		checker: func(string) bool { return true },
+		forward: forward,
+		pool:    []string{backendAddr(backend)},
+	}
+	b.Check()
+
+	rw := httptest.NewRecorder()
+	b.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "body", rw.Body.String())
+	assert.Equal(t, "abc", rw.Result().Trailer.Get("X-Checksum"))
+}
+
+func TestBalancerTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(rw, "data: %d\n\n", i)
+			rw.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	b := &Balancer{
+		checker: func(string) bool { return true },
+		forward: forward,
+	}
+	config := lbconfig.Default()
+	config.Backends = []lbconfig.Backend{{Addr: backendAddr(backend)}}
+	config.Timeout = lbconfig.Duration{Duration: 150 * time.Millisecond}
+	config.Retries.Attempts = 1
+	b.Apply(config, nil)
+	b.Check()
+
+	// The stream outlives the timeout once its headers came.
+	rw := httptest.NewRecorder()
+	b.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/events", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 4, strings.Count(rw.Body.String(), "data: "))
+
+	assert.Equal(t, http.StatusBadGateway, serve(b, "/slow"))
+}
+
+func TestForwardStreaming(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(rw, "data: %d\n\n", i)
+			rw.(http.Flusher).Flush()
+			<-release
+		}
+	}))
+	defer backend.Close()
+
+	b := &Balancer{
+		checker: func(string) bool { return true },
+		forward: forward,
+		pool:    []string{backendAddr(backend)},
+	}
+	b.Check()
+	frontend := httptest.NewServer(b)
+	defer frontend.Close()
+	defer close(release)
+
+	resp, err := http.Get(frontend.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	// The first event comes through while the backend holds the second.
+	line := make(chan string, 1)
+	go func() {
+		text, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- text
+	}()
+	select {
+	case text := <-line:
+		assert.Equal(t, "data: 0\n", text)
+	case <-time.After(time.Second):
+		t.Fatal("The event was not flushed")
+	}
+}
+
+func TestStreamingOutlivesServerTimeouts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			fmt.Fprintf(rw, "data: %d\n\n", i)
+			rw.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	b := &Balancer{
+		checker: func(string) bool { return true },
+		forward: forward,
+		pool:    []string{backendAddr(backend)},
+	}
+	b.Check()
+	frontend := httptest.NewUnstartedServer(b)
+	frontend.Config.ReadTimeout = 150 * time.Millisecond
+	frontend.Config.WriteTimeout = 150 * time.Millisecond
+	frontend.Start()
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(body), "data: "))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// retryReserve is how many retries the budget allows in a burst, before
+// requests pay for them.
+const retryReserve = 10
+
+// retryBudget lets the retries be at most a ratio of the requests over time.
+// Its owner guards it with a lock of its own.
+type retryBudget struct {
+	spent float64
+}
+
+// deposit is called for every request.
+func (rb *retryBudget) deposit(ratio float64) {
+	if rb.spent -= ratio; rb.spent < 0 {
+		rb.spent = 0
+	}
+}
+
+func (rb *retryBudget) available() bool {
+	return rb.spent+1 <= retryReserve
+}
+
+func (rb *retryBudget) withdraw() {
+	rb.spent++
+}
+
+// idempotent methods can be sent again without changing the outcome.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// bufferBody reads the body of the request, up to limit bytes, so that it
+// can be sent more than once. It returns false, with the body of the request
+// left whole, if it is larger.
+func bufferBody(r *http.Request, limit int64) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return nil, false
+	}
+	return data, true
+}
+
+// attemptWriter passes the response of an attempt through, unless retry
+// wants its status retried, in which case the response is dropped.
+type attemptWriter struct {
+	rw     http.ResponseWriter
+	header http.Header
+	retry  func(status int) bool
+	// started, if set, is called once the response headers are written.
+	started func()
+
+	status int
+	// dropped is set when the response is dropped for a retry.
+	dropped bool
+}
+
+func newAttemptWriter(rw http.ResponseWriter, retry func(status int) bool) *attemptWriter {
+	return &attemptWriter{rw: rw, header: make(http.Header), retry: retry}
+}
+
+// Header is the header of the response passed through once it is written,
+// so that trailers set after the body reach the client.
+func (w *attemptWriter) Header() http.Header {
+	if w.status != 0 && !w.dropped {
+		return w.rw.Header()
+	}
+	return w.header
+}
+
+func (w *attemptWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if w.started != nil {
+		w.started()
+	}
+	if w.retry != nil && w.retry(status) {
+		w.dropped = true
+		return
+	}
+
+	for k, values := range w.header {
+		w.rw.Header()[k] = append(w.rw.Header()[k], values...)
+	}
+	w.rw.WriteHeader(status)
+}
+
+func (w *attemptWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.dropped {
+		return len(data), nil
+	}
+	return w.rw.Write(data)
+}
+
+// Flush sends what was written so far, unless the response is dropped.
+func (w *attemptWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.dropped {
+		_ = http.NewResponseController(w.rw).Flush()
+	}
+}
+
+func (w *attemptWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+// retryBalancer has three servers behind round-robin: srv1 refuses
+// connections, srv2 answers 503 and srv3 answers with the body it got.
+func retryBalancer(configure func(config *lbconfig.Config)) (*Balancer, *[]string) {
+	var (
+		mu    sync.Mutex
+		tried []string
+	)
+	b := &Balancer{
+		strategy: &roundRobin{},
+		checker:  func(string) bool { return true },
+		forward: func(dst string, rw http.ResponseWriter, r *http.Request) error {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			tried = append(tried, dst)
+			mu.Unlock()
+
+			switch dst {
+			case "srv1":
+				return errors.New("connection refused")
+			case "srv2":
+				rw.WriteHeader(http.StatusServiceUnavailable)
+			default:
+				rw.Header().Set("Content-Type", "text/plain")
+				_, _ = rw.Write(body)
+			}
+			return nil
+		},
+	}
+	config := lbconfig.Default()
+	config.Backends = []lbconfig.Backend{{Addr: "srv1"}, {Addr: "srv2"}, {Addr: "srv3"}}
+	config.CircuitBreaker.Failures = 1000
+	if configure != nil {
+		configure(config)
+	}
+	b.Apply(config, nil)
+	b.Check()
+	return b, &tried
+}
+
+func TestRetries(t *testing.T) {
+	defer func(old bool) { *traceEnabled = old }(*traceEnabled)
+	*traceEnabled = true
+
+	t.Run("Failover", func(t *testing.T) {
+		b, tried := retryBalancer(nil)
+
+		rw := httptest.NewRecorder()
+		b.ServeHTTP(rw, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("data")))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "data", rw.Body.String(), "the body is sent again")
+		assert.Equal(t, "3", rw.Header().Get("lb-attempts"))
+		assert.Equal(t, "text/plain", rw.Header().Get("Content-Type"))
+		assert.Equal(t, []string{"srv1", "srv2", "srv3"}, *tried)
+	})
+
+	t.Run("Out of attempts", func(t *testing.T) {
+		b, tried := retryBalancer(func(config *lbconfig.Config) {
+			config.Retries.Attempts = 2
+		})
+
+		rw := httptest.NewRecorder()
+		b.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code, "the last response is passed on")
+		assert.Equal(t, "2", rw.Header().Get("lb-attempts"))
+		assert.Equal(t, []string{"srv1", "srv2"}, *tried)
+	})
+
+	t.Run("Status not retried", func(t *testing.T) {
+		b, tried := retryBalancer(func(config *lbconfig.Config) {
+			config.Retries.OnStatus = []int{http.StatusBadGateway}
+		})
+
+		assert.Equal(t, http.StatusServiceUnavailable, serve(b, "/"))
+		assert.Equal(t, []string{"srv1", "srv2"}, *tried)
+	})
+
+	t.Run("Not idempotent", func(t *testing.T) {
+		b, tried := retryBalancer(nil)
+
+		rw := httptest.NewRecorder()
+		b.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("data")))
+		assert.Equal(t, http.StatusBadGateway, rw.Code)
+		assert.Equal(t, "1", rw.Header().Get("lb-attempts"))
+		assert.Equal(t, []string{"srv1"}, *tried)
+	})
+
+	t.Run("Large body", func(t *testing.T) {
+		b, tried := retryBalancer(func(config *lbconfig.Config) {
+			config.Retries.MaxBodySize = 3
+		})
+
+		rw := httptest.NewRecorder()
+		b.ServeHTTP(rw, httptest.NewRequest(http.MethodPut, "/", strings.NewReader("data")))
+		assert.Equal(t, http.StatusBadGateway, rw.Code)
+		assert.Equal(t, []string{"srv1"}, *tried)
+	})
+
+	t.Run("Budget", func(t *testing.T) {
+		b, tried := retryBalancer(func(config *lbconfig.Config) {
+			config.Retries.Budget = 0
+		})
+
+		for i := 0; i < retryReserve/2; i++ {
+			assert.Equal(t, http.StatusOK, serve(b, "/"))
+		}
+		*tried = nil
+		assert.Equal(t, http.StatusBadGateway, serve(b, "/"), "the budget is spent")
+		assert.Len(t, *tried, 1)
+	})
+}
+
+func TestRetryBudget(t *testing.T) {
+	var budget retryBudget
+	for i := 0; i < retryReserve; i++ {
+		assert.True(t, budget.available())
+		budget.withdraw()
+	}
+	assert.False(t, budget.available())
+
+	for i := 0; i < 3; i++ {
+		budget.deposit(0.25)
+	}
+	assert.False(t, budget.available())
+	budget.deposit(0.25)
+	assert.True(t, budget.available())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ringReplicas is the number of points each server gets on the ring, which
+// evens out the share of keys every server owns.
+const ringReplicas = 100
+
+// ring is a consistent hashing ring: a key belongs to the first server point
+// clockwise from its hash. Removing a server only moves the keys it owned.
+type ring struct {
+	hashes  []uint64
+	servers []string
+	size    int
+}
+
+func newRing(servers []string, hash func(string) uint64) *ring {
+	type point struct {
+		hash   uint64
+		server string
+	}
+
+	points := make([]point, 0, len(servers)*ringReplicas)
+	for _, server := range servers {
+		for i := 0; i < ringReplicas; i++ {
+			points = append(points, point{hash: mix(hash(fmt.Sprintf("%s#%d", server, i))), server: server})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	r := &ring{size: len(servers)}
+	for _, p := range points {
+		r.hashes = append(r.hashes, p.hash)
+		r.servers = append(r.servers, p.server)
+	}
+	return r
+}
+
+// lookup walks the ring clockwise from the hash, passing over the servers in
+// skip, and returns the first server accept agrees to, or the first one not
+// skipped if it refuses them all.
+func (r *ring) lookup(hash uint64, skip map[string]bool, accept func(server string) bool) (string, bool) {
+	if len(r.hashes) == 0 {
+		return "", false
+	}
+
+	hash = mix(hash)
+	start := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+
+	first := ""
+	seen := make(map[string]bool, r.size)
+	for i := 0; i < len(r.hashes) && len(seen) < r.size; i++ {
+		server := r.servers[(start+i)%len(r.hashes)]
+		if seen[server] {
+			continue
+		}
+		seen[server] = true
+		if skip[server] {
+			continue
+		}
+		if accept(server) {
+			return server, true
+		}
+		if first == "" {
+			first = server
+		}
+	}
+	return first, first != ""
+}
+
+// mix spreads FNV hashes of similar strings, such as "server#1" and
+// "server#2", over the whole ring.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+)
+
+// stickyServer returns the server named by the sticky cookie of the
+// request, if the cookie is signed by us and the server is active.
+func (b *Balancer) stickyServer(r *http.Request, sticky lbconfig.Sticky) (string, bool) {
+	if sticky.Cookie == "" {
+		return "", false
+	}
+	cookie, err := r.Cookie(sticky.Cookie)
+	if err != nil {
+		return "", false
+	}
+	encoded, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return "", false
+	}
+	server, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !hmac.Equal([]byte(signature), []byte(b.sign(string(server), sticky))) {
+		return "", false
+	}
+	for _, s := range b.active {
+		if s == string(server) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// stickyCookie names the server in a signed cookie.
+func (b *Balancer) stickyCookie(server string, sticky lbconfig.Sticky, r *http.Request) *http.Cookie {
+	b.mu.Lock()
+	signature := b.sign(server, sticky)
+	b.mu.Unlock()
+
+	return &http.Cookie{
+		Name:     sticky.Cookie,
+		Value:    base64.RawURLEncoding.EncodeToString([]byte(server)) + "." + signature,
+		Path:     "/",
+		MaxAge:   int(sticky.MaxAge.Seconds()),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sign must be called with b.mu held.
+func (b *Balancer) sign(server string, sticky lbconfig.Sticky) string {
+	secret := []byte(sticky.Secret)
+	if len(secret) == 0 {
+		if b.secret == nil {
+			b.secret = make([]byte, 32)
+			_, _ = rand.Read(b.secret)
+		}
+		secret = b.secret
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(server))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+	"github.com/stretchr/testify/assert"
+)
+
+func stickyBalancer(down map[string]bool) *Balancer {
+	b := &Balancer{
+		strategy: &roundRobin{},
+		checker:  func(server string) bool { return !down[server] },
+		forward: func(dst string, rw http.ResponseWriter, r *http.Request) error {
+			rw.Header().Set("lb-from", dst)
+			rw.WriteHeader(http.StatusOK)
+			return nil
+		},
+	}
+	config := lbconfig.Default()
+	config.Backends = []lbconfig.Backend{{Addr: "srv1"}, {Addr: "srv2"}, {Addr: "srv3"}}
+	config.HealthCheck.UnhealthyThreshold = 1
+	config.Sticky.Cookie = "lb-server"
+	b.Apply(config, nil)
+	captureOutput(b.Check)
+	return b
+}
+
+// stickyRequest returns the server that got the request and the sticky
+// cookie set by the response, if any.
+func stickyRequest(b *Balancer, cookie *http.Cookie) (string, *http.Cookie) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	rw := httptest.NewRecorder()
+	b.ServeHTTP(rw, r)
+
+	resp := rw.Result()
+	for _, c := range resp.Cookies() {
+		if c.Name == "lb-server" {
+			return resp.Header.Get("lb-from"), c
+		}
+	}
+	return resp.Header.Get("lb-from"), nil
+}
+
+func TestStickySessions(t *testing.T) {
+	down := make(map[string]bool)
+	b := stickyBalancer(down)
+
+	server, cookie := stickyRequest(b, nil)
+	if assert.NotNil(t, cookie) {
+		assert.True(t, cookie.HttpOnly)
+		assert.NotContains(t, cookie.Value, server, "the cookie does not show the address")
+	}
+	for i := 0; i < 5; i++ {
+		dst, again := stickyRequest(b, cookie)
+		assert.Equal(t, server, dst)
+		assert.Nil(t, again, "the cookie is set once")
+	}
+
+	t.Run("Forged", func(t *testing.T) {
+		forged := *cookie
+		forged.Value = strings.Replace(cookie.Value, ".", ".x", 1)
+		var servers []string
+		for i := 0; i < 3; i++ {
+			dst, again := stickyRequest(b, &forged)
+			assert.NotNil(t, again, "a new cookie replaces the forged one")
+			servers = append(servers, dst)
+		}
+		assert.ElementsMatch(t, []string{"srv1", "srv2", "srv3"}, servers, "the strategy picks")
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		down[server] = true
+		captureOutput(b.Check)
+
+		dst, again := stickyRequest(b, cookie)
+		assert.NotEqual(t, server, dst)
+		if assert.NotNil(t, again) {
+			next, _ := stickyRequest(b, again)
+			assert.Equal(t, dst, next, "the session moves to the new server")
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		config := *b.config()
+		config.Sticky.Cookie = ""
+		b.Apply(&config, nil)
+
+		_, cookie := stickyRequest(b, nil)
+		assert.Nil(t, cookie)
+	})
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Strategy chooses the backend of every request among the healthy ones.
+// Implementations are safe for concurrent use.
+type Strategy interface {
+	// Update replaces the healthy backends, after every health check.
+	Update(backends []Backend)
+	// Pick returns the backend for the request other than those already
+	// tried for it, false if there is none.
+	Pick(r *http.Request, tried map[string]bool) (string, bool)
+	// Done reports the end of a request sent to a backend returned by Pick.
+	Done(server string)
+}
+
+type Backend struct {
+	Addr   string
+	Weight int
+}
+
+func addrs(backends []Backend) []string {
+	list := make([]string, len(backends))
+	for i, b := range backends {
+		list[i] = b.Addr
+	}
+	return list
+}
+
+// untried returns the servers that have not been tried, servers itself if
+// none were.
+func untried(servers []string, tried map[string]bool) []string {
+	if len(tried) == 0 {
+		return servers
+	}
+	var list []string
+	for _, server := range servers {
+		if !tried[server] {
+			list = append(list, server)
+		}
+	}
+	return list
+}
+
+// newStrategy creates a strategy by its -strategy flag name.
+func newStrategy(name string, loadFactor float64) (Strategy, error) {
+	switch name {
+	case "round-robin":
+		return &roundRobin{}, nil
+	case "least-connections":
+		return &leastConnections{}, nil
+	case "weighted":
+		return &weightedRoundRobin{}, nil
+	case "power-of-two":
+		return &powerOfTwo{rand: newRand()}, nil
+	case "random":
+		return &randomChoice{rand: newRand()}, nil
+	case "hash", "hash:path":
+		return newConsistentHash(pathKey, loadFactor), nil
+	case "hash:ip":
+		return newConsistentHash(clientIP, loadFactor), nil
+	}
+
+	if header, ok := strings.CutPrefix(name, "hash:header:"); ok && header != "" {
+		return newConsistentHash(headerKey(header), loadFactor), nil
+	}
+	if cookie, ok := strings.CutPrefix(name, "hash:cookie:"); ok && cookie != "" {
+		return newConsistentHash(cookieKey(cookie), loadFactor), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q, use round-robin, least-connections, weighted, power-of-two, random, hash:path, hash:ip, hash:header:<name> or hash:cookie:<name>", name)
+}
+
+func newRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+func hash(s string) uint64 {
+	hasher := fnv.New64()
+	_, _ = hasher.Write([]byte(s))
+	return hasher.Sum64()
+}
+
+// inflight counts the requests in flight on every backend. Its owner guards
+// it with a lock of its own.
+type inflight struct {
+	counts map[string]int
+	total  int
+}
+
+func (f *inflight) add(server string) {
+	if f.counts == nil {
+		f.counts = make(map[string]int)
+	}
+	f.counts[server]++
+	f.total++
+}
+
+func (f *inflight) remove(server string) {
+	if _, ok := f.counts[server]; !ok {
+		return
+	}
+	f.total--
+	if f.counts[server]--; f.counts[server] <= 0 {
+		delete(f.counts, server)
+	}
+}
+
+type roundRobin struct {
+	mu       sync.Mutex
+	backends []string
+	next     int
+}
+
+func (s *roundRobin) Update(backends []Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backends = addrs(backends)
+}
+
+func (s *roundRobin) Pick(_ *http.Request, tried map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.backends {
+		server := s.backends[(s.next+i)%len(s.backends)]
+		if !tried[server] {
+			s.next += i + 1
+			return server, true
+		}
+	}
+	return "", false
+}
+
+func (s *roundRobin) Done(string) {}
+
+// leastConnections picks the backend with the fewest requests in flight,
+// taking turns among equally loaded ones.
+type leastConnections struct {
+	mu       sync.Mutex
+	backends []string
+	load     inflight
+	next     int
+}
+
+func (s *leastConnections) Update(backends []Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backends = addrs(backends)
+}
+
+func (s *leastConnections) Pick(_ *http.Request, tried map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best := ""
+	for i := range s.backends {
+		server := s.backends[(s.next+i)%len(s.backends)]
+		if tried[server] {
+			continue
+		}
+		if best == "" || s.load.counts[server] < s.load.counts[best] {
+			best = server
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	s.next++
+	s.load.add(best)
+	return best, true
+}
+
+func (s *leastConnections) Done(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load.remove(server)
+}
+
+// weightedRoundRobin is the smooth weighted round-robin of nginx: a backend
+// of weight 5 among two of weight 1 gets 5 of every 7 requests, interleaved
+// with the others rather than in a row.
+type weightedRoundRobin struct {
+	mu    sync.Mutex
+	peers []*weightedPeer
+}
+
+type weightedPeer struct {
+	addr    string
+	weight  int
+	current int
+}
+
+// Update keeps the position in the rotation of the backends that stay, so
+// the frequent refreshes on health changes do not skew the distribution.
+func (s *weightedRoundRobin) Update(backends []Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := make(map[string]*weightedPeer, len(s.peers))
+	for _, p := range s.peers {
+		old[p.addr] = p
+	}
+
+	peers := make([]*weightedPeer, 0, len(backends))
+	for _, b := range backends {
+		weight := b.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		p, ok := old[b.Addr]
+		if !ok {
+			p = &weightedPeer{addr: b.Addr}
+		}
+		p.weight = weight
+		peers = append(peers, p)
+	}
+	s.peers = peers
+}
+
+func (s *weightedRoundRobin) Pick(_ *http.Request, tried map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		best  *weightedPeer
+		total int
+	)
+	for _, p := range s.peers {
+		if tried[p.addr] {
+			continue
+		}
+		p.current += p.weight
+		total += p.weight
+		if best == nil || p.current > best.current {
+			best = p
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	best.current -= total
+	return best.addr, true
+}
+
+func (s *weightedRoundRobin) Done(string) {}
+
+// powerOfTwo samples two backends at random and picks the less loaded one,
+// which keeps the load nearly as even as least-connections without every
+// balancer instance flocking to the same backend.
+type powerOfTwo struct {
+	mu       sync.Mutex
+	backends []string
+	load     inflight
+	rand     *rand.Rand
+}
+
+func (s *powerOfTwo) Update(backends []Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backends = addrs(backends)
+}
+
+func (s *powerOfTwo) Pick(_ *http.Request, tried map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backends := untried(s.backends, tried)
+	n := len(backends)
+	if n == 0 {
+		return "", false
+	}
+
+	server := backends[0]
+	if n > 1 {
+		i, j := s.rand.Intn(n), s.rand.Intn(n-1)
+		if j >= i {
+			j++
+		}
+		server = backends[i]
+		if other := backends[j]; s.load.counts[other] < s.load.counts[server] {
+			server = other
+		}
+	}
+	s.load.add(server)
+	return server, true
+}
+
+func (s *powerOfTwo) Done(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load.remove(server)
+}
+
+type randomChoice struct {
+	mu       sync.Mutex
+	backends []string
+	rand     *rand.Rand
+}
+
+func (s *randomChoice) Update(backends []Backend) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backends = addrs(backends)
+}
+
+func (s *randomChoice) Pick(_ *http.Request, tried map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	backends := untried(s.backends, tried)
+	if len(backends) == 0 {
+		return "", false
+	}
+	return backends[s.rand.Intn(len(backends))], true
+}
+
+func (s *randomChoice) Done(string) {}
+
+// consistentHash sends requests with the same key to the same backend with
+// consistent hashing with bounded loads: the owner of the key on the ring
+// takes it unless it already has more than loadFactor times the average
+// number of requests in flight, in which case the next backend on the ring
+// does. Retries go to the next backend on the ring.
+type consistentHash struct {
+	key        func(r *http.Request) string
+	loadFactor float64
+
+	mu   sync.Mutex
+	ring *ring
+	load inflight
+}
+
+func newConsistentHash(key func(r *http.Request) string, loadFactor float64) *consistentHash {
+	if loadFactor < 1 {
+		loadFactor = defaultLoadFactor
+	}
+	return &consistentHash{key: key, loadFactor: loadFactor, ring: newRing(nil, hash)}
+}
+
+func (s *consistentHash) Update(backends []Backend) {
+	r := newRing(addrs(backends), hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ring = r
+}
+
+func (s *consistentHash) Pick(r *http.Request, tried map[string]bool) (string, bool) {
+	return s.pick(s.key(r), tried)
+}
+
+func (s *consistentHash) pick(key string, tried map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	capacity := s.capacity()
+	server, ok := s.ring.lookup(hash(key), tried, func(server string) bool {
+		return s.load.counts[server] < capacity
+	})
+	if !ok {
+		return "", false
+	}
+	s.load.add(server)
+	return server, true
+}
+
+// capacity is the most requests in flight a backend may have, counting the
+// one being placed.
+func (s *consistentHash) capacity() int {
+	if s.ring.size == 0 {
+		return 0
+	}
+	return int(math.Ceil(s.loadFactor * float64(s.load.total+1) / float64(s.ring.size)))
+}
+
+func (s *consistentHash) Done(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load.remove(server)
+}
+
+func pathKey(r *http.Request) string {
+	return r.URL.Path
+}
+
+// headerKey and cookieKey fall back to the client address for requests
+// without the header or cookie.
+func headerKey(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if value := r.Header.Get(name); value != "" {
+			return value
+		}
+		return clientIP(r)
+	}
+}
+
+func cookieKey(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+		return clientIP(r)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
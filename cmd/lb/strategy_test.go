@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var threeBackends = []Backend{{Addr: "srv1"}, {Addr: "srv2"}, {Addr: "srv3"}}
+
+func request(path string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, path, nil)
+}
+
+// distribution picks n times, ending every request right away unless hold
+// is set.
+func distribution(s Strategy, n int, hold bool) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		server, ok := s.Pick(request(fmt.Sprintf("/path/%d", i)), nil)
+		if !ok {
+			return counts
+		}
+		counts[server]++
+		if !hold {
+			s.Done(server)
+		}
+	}
+	return counts
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{"round-robin", "least-connections", "weighted", "power-of-two", "random", "hash", "hash:path", "hash:ip", "hash:header:X-User", "hash:cookie:session"} {
+		s, err := newStrategy(name, 1.25)
+		assert.NoError(t, err, name)
+		assert.NotNil(t, s, name)
+	}
+	for _, name := range []string{"", "fastest", "hash:header:", "hash:query"} {
+		_, err := newStrategy(name, 1.25)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestEmptyStrategies(t *testing.T) {
+	for _, name := range []string{"round-robin", "least-connections", "weighted", "power-of-two", "random", "hash"} {
+		s, _ := newStrategy(name, 1.25)
+		_, ok := s.Pick(request("/"), nil)
+		assert.False(t, ok, "%s picked from no backends", name)
+
+		s.Update(threeBackends)
+		s.Update(nil)
+		_, ok = s.Pick(request("/"), nil)
+		assert.False(t, ok, "%s picked from no backends after an update", name)
+	}
+}
+
+func TestStrategiesSkipTried(t *testing.T) {
+	for _, name := range []string{"round-robin", "least-connections", "weighted", "power-of-two", "random", "hash"} {
+		s, _ := newStrategy(name, 1.25)
+		s.Update(threeBackends)
+
+		for i := 0; i < 10; i++ {
+			server, ok := s.Pick(request(fmt.Sprintf("/path/%d", i)), map[string]bool{"srv1": true, "srv3": true})
+			assert.True(t, ok, name)
+			assert.Equal(t, "srv2", server, name)
+			s.Done(server)
+		}
+		_, ok := s.Pick(request("/"), map[string]bool{"srv1": true, "srv2": true, "srv3": true})
+		assert.False(t, ok, "%s picked a tried backend", name)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	s := &roundRobin{}
+	s.Update(threeBackends)
+
+	assert.Equal(t, map[string]int{"srv1": 100, "srv2": 100, "srv3": 100}, distribution(s, 300, false))
+}
+
+func TestLeastConnections(t *testing.T) {
+	s := &leastConnections{}
+	s.Update(threeBackends)
+
+	// Held requests spread evenly.
+	assert.Equal(t, map[string]int{"srv1": 4, "srv2": 4, "srv3": 4}, distribution(s, 12, true))
+
+	// Finished requests make room on their backend first.
+	s.Done("srv2")
+	s.Done("srv2")
+	server, _ := s.Pick(request("/"), nil)
+	assert.Equal(t, "srv2", server)
+	server, _ = s.Pick(request("/"), nil)
+	assert.Equal(t, "srv2", server)
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	s := &weightedRoundRobin{}
+	s.Update([]Backend{{Addr: "srv1", Weight: 5}, {Addr: "srv2", Weight: 1}, {Addr: "srv3"}})
+
+	assert.Equal(t, map[string]int{"srv1": 50, "srv2": 10, "srv3": 10}, distribution(s, 70, false))
+
+	// The heavy backend is interleaved with the others, not picked in a row.
+	var sequence []string
+	for i := 0; i < 7; i++ {
+		server, _ := s.Pick(request("/"), nil)
+		sequence = append(sequence, server)
+	}
+	assert.Equal(t, []string{"srv1", "srv1", "srv2", "srv1", "srv3", "srv1", "srv1"}, sequence)
+
+	// Refreshing the same backends keeps the rotation going.
+	sequence = sequence[:0]
+	for i := 0; i < 7; i++ {
+		server, _ := s.Pick(request("/"), nil)
+		sequence = append(sequence, server)
+		s.Update([]Backend{{Addr: "srv1", Weight: 5}, {Addr: "srv2", Weight: 1}, {Addr: "srv3"}})
+	}
+	assert.Equal(t, []string{"srv1", "srv1", "srv2", "srv1", "srv3", "srv1", "srv1"}, sequence)
+}
+
+func TestPowerOfTwo(t *testing.T) {
+	s := &powerOfTwo{rand: newRand()}
+	s.Update(threeBackends)
+
+	// Two distinct samples never both land on the loaded backend.
+	for i := 0; i < 10; i++ {
+		s.load.add("srv1")
+	}
+	counts := distribution(s, 1000, false)
+	assert.Zero(t, counts["srv1"])
+	assert.InDelta(t, 500, counts["srv2"], 100)
+
+	// With held requests the load stays nearly even.
+	s = &powerOfTwo{rand: newRand()}
+	s.Update(threeBackends)
+	counts = distribution(s, 300, true)
+	for server, n := range counts {
+		assert.InDelta(t, 100, n, 10, server)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	s := &randomChoice{rand: newRand()}
+	s.Update(threeBackends)
+
+	counts := distribution(s, 3000, false)
+	for _, b := range threeBackends {
+		assert.InDelta(t, 1000, counts[b.Addr], 200, b.Addr)
+	}
+}
+
+func TestConsistentHashKeys(t *testing.T) {
+	header := newConsistentHash(headerKey("X-User"), 1.25)
+	cookie := newConsistentHash(cookieKey("session"), 1.25)
+	ip := newConsistentHash(clientIP, 1.25)
+	for _, s := range []*consistentHash{header, cookie, ip} {
+		s.Update(threeBackends)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		user := fmt.Sprintf("user-%d", i)
+
+		first := request("/a")
+		first.Header.Set("X-User", user)
+		second := request("/b")
+		second.Header.Set("X-User", user)
+		assert.Equal(t, pick(header, first), pick(header, second), "same header")
+
+		first.AddCookie(&http.Cookie{Name: "session", Value: user})
+		second.AddCookie(&http.Cookie{Name: "session", Value: user})
+		assert.Equal(t, pick(cookie, first), pick(cookie, second), "same cookie")
+
+		first.RemoteAddr = fmt.Sprintf("10.0.%d.%d:1000", i/256, i%256)
+		second.RemoteAddr = fmt.Sprintf("10.0.%d.%d:2000", i/256, i%256)
+		server := pick(ip, first)
+		assert.Equal(t, server, pick(ip, second), "same client IP")
+		counts[server]++
+	}
+	for _, b := range threeBackends {
+		assert.InDelta(t, 100, counts[b.Addr], 40, b.Addr)
+	}
+
+	// Without the header the client address is the key.
+	noHeader := request("/")
+	noHeader.RemoteAddr = "10.1.1.1:1000"
+	assert.Equal(t, pick(ip, noHeader), pick(header, noHeader))
+}
+
+func pick(s Strategy, r *http.Request) string {
+	server, _ := s.Pick(r, nil)
+	s.Done(server)
+	return server
+}
+
+func TestConsistentHashBoundedLoad(t *testing.T) {
+	s := newConsistentHash(pathKey, 1.25)
+	s.Update(append(threeBackends, Backend{Addr: "srv4"}))
+
+	// Requests for one path pile up on its owner only until it has more
+	// than its share of the load.
+	var picked []string
+	for i := 0; i < 8; i++ {
+		server, _ := s.Pick(request("/hot"), nil)
+		picked = append(picked, server)
+	}
+	for server, load := range s.load.counts {
+		assert.LessOrEqual(t, load, 3, server)
+	}
+	assert.Greater(t, len(s.load.counts), 1)
+
+	for _, server := range picked {
+		s.Done(server)
+	}
+	assert.Empty(t, s.load.counts)
+	assert.Equal(t, 0, s.load.total)
+	assert.Equal(t, picked[0], pick(s, request("/hot")), "an idle owner gets its keys back")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketProxying(t *testing.T) {
+	echo := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		_, _ = io.Copy(ws, ws)
+	}))
+	defer echo.Close()
+
+	b := &Balancer{
+		checker: func(string) bool { return true },
+		forward: forward,
+	}
+	config := lbconfig.Default()
+	config.Backends = []lbconfig.Backend{{Addr: backendAddr(echo)}}
+	// The session outlives the timeout of the handshake.
+	config.Timeout = lbconfig.Duration{Duration: 100 * time.Millisecond}
+	b.Apply(config, nil)
+	b.Check()
+
+	// The session also outlives the timeouts of the frontend server.
+	frontend := httptest.NewUnstartedServer(b)
+	frontend.Config.ReadTimeout = 100 * time.Millisecond
+	frontend.Config.WriteTimeout = 100 * time.Millisecond
+	frontend.Start()
+	defer frontend.Close()
+
+	ws, err := websocket.Dial(strings.Replace(frontend.URL, "http", "ws", 1), "", frontend.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+
+	for _, message := range []string{"hello", "world"} {
+		assert.NoError(t, websocket.Message.Send(ws, message))
+		var reply string
+		assert.NoError(t, websocket.Message.Receive(ws, &reply))
+		assert.Equal(t, message, reply)
+		time.Sleep(150 * time.Millisecond)
+	}
+}
+
+func TestUpgradeRefused(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "websocket", r.Header.Get("Upgrade"))
+		http.Error(rw, "Upgrade not supported", http.StatusBadRequest)
+	}))
+	defer backend.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	rw := httptest.NewRecorder()
+	assert.NoError(t, forward(backendAddr(backend), rw, r))
+	assert.Equal(t, http.StatusBadRequest, rw.Code, "the answer of the backend is passed on")
+}
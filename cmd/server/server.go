@@ -1,16 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/VictorGOcking/lab-4/dbclient"
 	"github.com/VictorGOcking/lab-4/httptools"
 	"github.com/VictorGOcking/lab-4/signal"
 )
@@ -18,15 +18,11 @@ import (
 var port = flag.Int("port", 8080, "server port")
 
 const (
-	databaseURL          = "http://db:8085/db"
+	databaseURL          = "http://db:8085"
 	confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 	confHealthFailure    = "CONF_HEALTH_FAILURE"
 )
 
-type RequestStruct struct {
-	Value string `json:"value"`
-}
-
 type ResponseStruct struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
@@ -53,7 +49,7 @@ func addComplexHandlers(h *http.ServeMux, report Report, paths []string) {
 
 func main() {
 	h := http.NewServeMux()
-	client := http.DefaultClient
+	client := dbclient.New(databaseURL)
 
 	h.HandleFunc("/health", healthHandler)
 	report := make(Report)
@@ -86,7 +82,7 @@ func healthHandler(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func someDataHandler(client *http.Client, report Report) http.HandlerFunc {
+func someDataHandler(client *dbclient.Client, report Report) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
 		if key == "" {
@@ -94,23 +90,12 @@ func someDataHandler(client *http.Client, report Report) http.HandlerFunc {
 			return
 		}
 
-		resp, err := client.Get(fmt.Sprintf("%s/%s", databaseURL, key))
-		if err != nil {
-			http.Error(rw, "Internal Server Error: failed to get data", http.StatusInternalServerError)
-			return
-		}
-		defer func(Body io.ReadCloser) {
-			err := Body.Close()
-			if err != nil {
-
-			}
-		}(resp.Body)
-
-		if resp.StatusCode == http.StatusNotFound {
+		value, err := client.Get(r.Context(), key)
+		if errors.Is(err, dbclient.ErrNotFound) {
 			http.Error(rw, "Not Found", http.StatusNotFound)
 			return
-		} else if resp.StatusCode != http.StatusOK {
-			http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
+		} else if err != nil {
+			http.Error(rw, "Internal Server Error: failed to get data", http.StatusInternalServerError)
 			return
 		}
 
@@ -120,33 +105,12 @@ func someDataHandler(client *http.Client, report Report) http.HandlerFunc {
 
 		report.Process(r)
 
-		var body ResponseStruct
-		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-			http.Error(rw, "Internal Server Error: failed to decode response", http.StatusInternalServerError)
-			return
-		}
-
 		rw.Header().Set("content-type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(body)
+		_ = json.NewEncoder(rw).Encode(ResponseStruct{Key: key, Value: value})
 	}
 }
 
-func storeCurrentDate(client *http.Client) {
-	buff := new(bytes.Buffer)
-	body := RequestStruct{Value: time.Now().Format(time.RFC3339)}
-	if err := json.NewEncoder(buff).Encode(body); err != nil {
-		return
-	}
-
-	resp, err := client.Post(fmt.Sprintf("%s/victorgocking", databaseURL), "application/json", buff)
-	if err != nil {
-		return
-	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-
-		}
-	}(resp.Body)
+func storeCurrentDate(client *dbclient.Client) {
+	_ = client.Put(context.Background(), "victorgocking", time.Now().Format(time.RFC3339))
 }
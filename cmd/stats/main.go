@@ -7,11 +7,17 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/VictorGOcking/lab-4/lbconfig"
 )
 
-var https = flag.Bool("https", false, "whether backends support HTTPs")
+var (
+	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	configPath = flag.String("config", "", "YAML or JSON file of the load balancer to take the backends from")
+)
 
-var serversPool = []string{
+// defaultPool is the docker-compose setup seen from the host.
+var defaultPool = []string{
 	"localhost:8080",
 	"localhost:8081",
 	"localhost:8082",
@@ -26,9 +32,18 @@ func scheme() string {
 	return "http"
 }
 
-func main()  {
+func main() {
 	flag.Parse()
 
+	serversPool := defaultPool
+	if *configPath != "" {
+		config, err := lbconfig.Load(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serversPool = config.Addrs()
+	}
+
 	client := new(http.Client)
 	client.Timeout = 10 * time.Second
 
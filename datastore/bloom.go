@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	bloomSuffix    = ".bloom"
+	bloomFalseRate = 0.01
+	// Every record takes at least 32 bytes on disk, which bounds the number
+	// of keys a segment of a given size can hold.
+	minEntrySize = 32
+)
+
+// BloomFilter answers whether a key may be stored in a segment. It never
+// gives false negatives, so a miss lets lookups skip the segment entirely.
+type BloomFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+// NewBloomFilter sizes the filter for the expected number of keys at the
+// target false positive rate.
+func NewBloomFilter(keys int) *BloomFilter {
+	if keys < 1 {
+		keys = 1
+	}
+	m := math.Ceil(-float64(keys) * math.Log(bloomFalseRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(keys) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+
+	return &BloomFilter{
+		bits:   make([]uint64, (int(m)+63)/64),
+		hashes: uint32(k),
+	}
+}
+
+func (bf *BloomFilter) locations(key string) (uint32, uint32) {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(key))
+	sum := hasher.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (bf *BloomFilter) Add(key string) {
+	h1, h2 := bf.locations(key)
+	size := uint32(len(bf.bits) * 64)
+	for i := uint32(0); i < bf.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (bf *BloomFilter) MayContain(key string) bool {
+	h1, h2 := bf.locations(key)
+	size := uint32(len(bf.bits) * 64)
+	for i := uint32(0); i < bf.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo stores the filter as the number of hash functions and words
+// followed by the bit set, all little endian.
+func (bf *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 8+8*len(bf.bits))
+	binary.LittleEndian.PutUint32(buf, bf.hashes)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(bf.bits)))
+	for i, word := range bf.bits {
+		binary.LittleEndian.PutUint64(buf[8+8*i:], word)
+	}
+
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+func (bf *BloomFilter) ReadFrom(r io.Reader) (int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	hashes := binary.LittleEndian.Uint32(header)
+	words := binary.LittleEndian.Uint32(header[4:])
+	if hashes == 0 || words == 0 {
+		return 8, fmt.Errorf("corrupted bloom filter")
+	}
+
+	data := make([]byte, 8*int(words))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 8, err
+	}
+
+	bf.hashes = hashes
+	bf.bits = make([]uint64, words)
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(data[8*i:])
+	}
+	return int64(8 + len(data)), nil
+}
+
+// writeBloom persists the filter next to the segment file.
+func writeBloom(segmentPath string, bf *BloomFilter) error {
+	f, err := os.Create(segmentPath + bloomSuffix)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(f)
+	if _, err := bf.WriteTo(out); err != nil {
+		f.Close()
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readBloom(segmentPath string) (*BloomFilter, error) {
+	f, err := os.Open(segmentPath + bloomSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bf := new(BloomFilter)
+	if _, err := bf.ReadFrom(bufio.NewReader(f)); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := NewBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		bf.Add(fmt.Sprintf("key%d", i))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if !bf.MayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("False negative for key%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.MayContain(fmt.Sprintf("missing%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 3*bloomFalseRate {
+		t.Errorf("False positive rate too high: %f", rate)
+	}
+
+	t.Run("Encoding", func(t *testing.T) {
+		var buf bytes.Buffer
+		if _, err := bf.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		decoded := new(BloomFilter)
+		if _, err := decoded.ReadFrom(&buf); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if !decoded.MayContain(fmt.Sprintf("key%d", i)) {
+				t.Fatalf("Decoded filter lost key%d", i)
+			}
+		}
+	})
+}
+
+func TestDatabaseBloom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+
+	t.Run("Sealed segment has a persisted filter", func(t *testing.T) {
+		bf, err := readBloom(db.segments.list[0].path)
+		if err != nil {
+			t.Fatal("Failed to read persisted filter:", err)
+		}
+		if !bf.MayContain("key1") || !bf.MayContain("key2") {
+			t.Errorf("Persisted filter misses stored keys")
+		}
+	})
+
+	t.Run("Compacted segment has a persisted filter", func(t *testing.T) {
+		db.Put("key4", "value4")
+		db.Put("key5", "value5")
+		time.Sleep(500 * time.Millisecond)
+
+		bf, err := readBloom(db.segments.snapshot()[0].path)
+		if err != nil {
+			t.Fatal("Failed to read persisted filter:", err)
+		}
+		for _, key := range []string{"key1", "key2", "key3"} {
+			if !bf.MayContain(key) {
+				t.Errorf("Compacted filter misses %s", key)
+			}
+		}
+	})
+
+	t.Run("Misses are counted", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			if _, err := db.Get(fmt.Sprintf("missing%d", i)); err != ErrNotFound {
+				t.Fatalf("Expected ErrNotFound, got %v", err)
+			}
+		}
+
+		stats := db.Stats()
+		if stats.BloomNegatives+stats.BloomFalsePositives < 100 {
+			t.Errorf("Expected at least 100 filtered lookups, got %+v", stats)
+		}
+		if stats.BloomFalsePositiveRate > 0.2 {
+			t.Errorf("False positive rate too high: %+v", stats)
+		}
+	})
+}
+
+func TestDatabaseBloomRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key3", "value3")
+	path := db.segments.list[0].path
+	db.Close()
+
+	t.Run("Saved filter is loaded", func(t *testing.T) {
+		// A filter that rules every key out shows which one is in use.
+		if err := writeBloom(path, NewBloomFilter(1)); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDb(dir, 85)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected the saved filter to rule key1 out, got %v", err)
+		}
+	})
+
+	t.Run("Corrupted filter is rebuilt", func(t *testing.T) {
+		if err := os.Truncate(path+bloomSuffix, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDb(dir, 85)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, key := range []string{"key1", "key2"} {
+			if _, err := db.Get(key); err != nil {
+				t.Errorf("Failed to get %s with a rebuilt filter: %v", key, err)
+			}
+		}
+		if bf, err := readBloom(path); err != nil || !bf.MayContain("key1") {
+			t.Errorf("Rebuilt filter was not saved: %v", err)
+		}
+	})
+}
@@ -6,17 +6,69 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
-	outFileName = "current-data"
-	bufferSize  = 8192 // 1 K = 8192 B
+	outFileName   = "current-data"
+	epochFileName = "epoch"
+	bufferSize    = 8192 // 1 K = 8192 B
+
+	// Versions carry the number of times the directory was opened above
+	// epochShift, so a version never names two different writes even though
+	// recovery renumbers the records it replays.
+	epochShift = 40
+
+	DefaultMaxKeySize     = 1 << 10
+	DefaultMaxValueSize   = 1 << 20
+	DefaultWriteQueueSize = 1024
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrConflict = fmt.Errorf("transaction conflict")
+	ErrTxnDone  = fmt.Errorf("transaction has already been committed or discarded")
+	ErrClosed   = fmt.Errorf("database is closed")
+	// ErrCorrupted is wrapped by the errors of records that fail their
+	// checksum or are cut short.
+	ErrCorrupted = fmt.Errorf("entry's checksum is wrong")
+
+	ErrEmptyKey      = fmt.Errorf("key is empty")
+	ErrKeyTooLarge   = fmt.Errorf("key is too large")
+	ErrValueTooLarge = fmt.Errorf("value is too large")
+
+	// ErrOverloaded rejects a write when the write queue is full; it is
+	// safe to retry later.
+	ErrOverloaded = fmt.Errorf("too many writes in progress")
+)
+
+// Options tune a database created with NewDbWithOptions. The zero value
+// matches NewDb.
+type Options struct {
+	Index          IndexMode
+	SparseInterval int
+
+	// Limits of writes in bytes, zero takes the defaults.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// WriteQueueSize bounds the writes waiting for the writer goroutine,
+	// zero takes the default.
+	WriteQueueSize int
+}
 
 type HashIndex map[string]int64
 
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
 type Db struct {
 	// Output options
 	out    *os.File
@@ -28,33 +80,87 @@ type Db struct {
 	// Goroutines handlers
 	operator HashOperator
 	ops      chan EntryElement
+	rejected atomic.Uint64
+	// closing stops the writer, closed is closed once it is done and stops
+	// the operations goroutine.
+	closing   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      sync.WaitGroup
 
 	// Hash indexing
 	index HashIndex
+
+	maxKeySize   int
+	maxValueSize int
+
+	// Versioning: every write gets the next version, versions holds the
+	// latest one for each key and is owned by the operations goroutine. In
+	// sparse mode it only holds the keys of the active segment, older keys
+	// take the version of the sealed segment they are found in.
+	version  uint64
+	versions map[string]keyState
+	active   *Segment
+
+	// Statistics
+	liveKeys  atomic.Int64
+	liveBytes atomic.Int64
+	reads     Histogram
+	writes    Histogram
+
+	watchers watcherSet
+}
+
+// keyState describes the latest record of a key.
+type keyState struct {
+	version uint64
+	size    int64
+	deleted bool
 }
 
 func NewDb(dir string, segmentSize int64) (*Db, error) {
+	return NewDbWithOptions(dir, segmentSize, Options{})
+}
+
+func NewDbWithOptions(dir string, segmentSize int64, opts Options) (*Db, error) {
 	db := &Db{
 		segments: NewSegmentList(segmentSize, dir),
 		operator: HashOperator{
 			queries: make(chan HashOperation),
-			answers: make(chan *SegmentPosition),
 		},
-		ops: make(chan EntryElement),
-	}
+		versions: make(map[string]keyState),
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
 
-	err := db.addSegment()
+		maxKeySize:   opts.MaxKeySize,
+		maxValueSize: opts.MaxValueSize,
+	}
+	if db.maxKeySize <= 0 {
+		db.maxKeySize = DefaultMaxKeySize
+	}
+	if db.maxValueSize <= 0 {
+		db.maxValueSize = DefaultMaxValueSize
+	}
+	queueSize := opts.WriteQueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultWriteQueueSize
+	}
+	db.ops = make(chan EntryElement, queueSize)
 
-	if err != nil {
-		return nil, err
+	if opts.Index == SparseIndexMode {
+		db.segments.spill = opts.SparseInterval
+		if db.segments.spill <= 0 {
+			db.segments.spill = defaultSparseInterval
+		}
 	}
 
-	err = db.recover()
-	if err != nil && err != io.EOF {
+	err := db.recover()
+	if err != nil {
 		return nil, err
 	}
 
 	// Start goroutines handlers
+	db.done.Add(2)
 	db.handleInput()
 	db.handleOperations()
 
@@ -62,6 +168,9 @@ func NewDb(dir string, segmentSize int64) (*Db, error) {
 }
 
 func (db *Db) addSegment() error {
+	if db.out != nil {
+		db.segments.GetLast().version = db.version
+	}
 	f, err := db.segments.Add()
 	db.out = f
 	db.offset = 0
@@ -69,50 +178,330 @@ func (db *Db) addSegment() error {
 	return err
 }
 
-func (db *Db) find(key string) *SegmentPosition {
+func (db *Db) find(key string) (*SegmentPosition, error) {
 	op := HashOperation{
-		put: false,
-		key: key,
+		put:    false,
+		key:    key,
+		answer: make(chan *SegmentPosition),
 	}
 
-	db.operator.queries <- op
-	return <-db.operator.answers
+	if !db.query(op) {
+		return nil, ErrClosed
+	}
+	return <-op.answer, nil
+}
+
+// query hands the operation to the operations goroutine, which answers it on
+// its channel. It reports false if the database is closed.
+func (db *Db) query(op HashOperation) bool {
+	select {
+	case db.operator.queries <- op:
+		return true
+	case <-db.closed:
+		return false
+	}
 }
 
 func (db *Db) Get(key string) (string, error) {
-	keyPos := db.find(key)
+	value, _, err := db.GetVersioned(key)
+	return value, err
+}
+
+// GetVersioned returns the value of the key together with the version of
+// its latest write. A deleted key reports ErrNotFound with the version of
+// the deletion; a key that was never written has version 0.
+func (db *Db) GetVersioned(key string) (string, uint64, error) {
+	defer db.reads.ObserveSince(time.Now())
+	keyPos, err := db.find(key)
+	if err != nil {
+		return "", 0, err
+	}
 	if keyPos == nil {
-		return "", ErrNotFound
+		return "", 0, ErrNotFound
 	}
 
 	value, err := keyPos.segment.Read(keyPos.position)
 	if err != nil {
-		return "", err
+		return "", keyPos.version, err
+	}
+
+	return value, keyPos.version, nil
+}
+
+// GetMany returns the values of the keys that are found and the keys that
+// are not. All keys are resolved against the same snapshot of the index and
+// the segment list, so no write lands between two of the lookups.
+func (db *Db) GetMany(keys []string) (map[string]string, []string, error) {
+	defer db.reads.ObserveSince(time.Now())
+	op := HashOperation{
+		many:      keys,
+		positions: make(chan []*SegmentPosition),
+	}
+
+	if !db.query(op) {
+		return nil, nil, ErrClosed
 	}
+	positions := <-op.positions
+
+	values := make(map[string]string, len(keys))
+	missing := make([]string, 0)
+	for i, key := range keys {
+		if positions[i] == nil {
+			missing = append(missing, key)
+			continue
+		}
 
-	return value, nil
+		value, err := positions[i].segment.Read(positions[i].position)
+		if err == ErrNotFound {
+			missing = append(missing, key)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		values[key] = value
+	}
+	return values, missing, nil
+}
+
+func (db *Db) findMany(keys []string) []*SegmentPosition {
+	list := db.segments.snapshot()
+	positions := make([]*SegmentPosition, len(keys))
+	for i, key := range keys {
+		seg, pos, err := db.segments.findIn(list, key)
+		if err != nil {
+			continue
+		}
+		positions[i] = &SegmentPosition{
+			seg,
+			pos,
+			db.versionAt(key, seg),
+		}
+	}
+	return positions
 }
 
 func (db *Db) Put(key, value string) error {
+	_, err := db.PutVersioned(key, value)
+	return err
+}
+
+// PutVersioned stores the value like Put and returns the version the write
+// got, which a later read of the key reports until it changes again.
+func (db *Db) PutVersioned(key, value string) (uint64, error) {
 	e := entry{
 		key:   key,
 		value: value,
 	}
 
-	ee := EntryElement{
-		ent: e,
-		err: make(chan error),
+	var version uint64
+	err := db.apply(EntryElement{
+		muts:    []EntryMutation{{ent: e}},
+		version: &version,
+	})
+	return version, err
+}
+
+// PutBatch writes all pairs with a single append to the active segment.
+func (db *Db) PutBatch(pairs []KeyValue) error {
+	muts := make([]EntryMutation, len(pairs))
+	for i, kv := range pairs {
+		muts[i] = EntryMutation{
+			ent: entry{
+				key:   kv.Key,
+				value: kv.Value,
+			},
+		}
 	}
 
-	db.ops <- ee
-	return <-ee.err
+	return db.apply(EntryElement{
+		muts: muts,
+	})
 }
 
+func (db *Db) Delete(key string) error {
+	e := entry{
+		key: key,
+	}
+
+	return db.apply(EntryElement{
+		muts: []EntryMutation{{ent: e, delete: true}},
+	})
+}
+
+// apply hands the element to the writer goroutine and waits for the result.
+// A full write queue fails the write with ErrOverloaded instead of blocking.
+func (db *Db) apply(ee EntryElement) error {
+	defer db.writes.ObserveSince(time.Now())
+	for _, m := range ee.muts {
+		if err := db.validate(m); err != nil {
+			return err
+		}
+	}
+	// The writer never blocks on the answer, even if Close gave up on it.
+	ee.err = make(chan error, 1)
+
+	select {
+	case <-db.closing:
+		return ErrClosed
+	default:
+	}
+	select {
+	case db.ops <- ee:
+	default:
+		db.rejected.Add(1)
+		return ErrOverloaded
+	}
+
+	select {
+	case err := <-ee.err:
+		return err
+	case <-db.closed:
+		// The writer is gone, the write was either done or never taken.
+		select {
+		case err := <-ee.err:
+			return err
+		default:
+			return ErrClosed
+		}
+	}
+}
+
+// validate checks a write against the size limits.
+func (db *Db) validate(m EntryMutation) error {
+	return checkLimits(m.ent, db.maxKeySize, db.maxValueSize)
+}
+
+// checkLimits checks an entry against the size limits of an engine. The
+// errors wrap ErrEmptyKey, ErrKeyTooLarge and ErrValueTooLarge.
+func checkLimits(e entry, maxKeySize, maxValueSize int) error {
+	if e.key == "" {
+		return ErrEmptyKey
+	}
+	if len(e.key) > maxKeySize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(e.key), maxKeySize)
+	}
+	if len(e.value) > maxValueSize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValueTooLarge, len(e.value), maxValueSize)
+	}
+	return nil
+}
+
+// recover replays the live segments from oldest to newest and keeps the
+// newest one open for writes. An empty directory starts with a new segment.
 func (db *Db) recover() error {
+	epoch, err := nextEpoch(db.segments.outDir)
+	if err != nil {
+		return err
+	}
+	db.version = epoch << epochShift
+
+	segments, err := db.segments.Restore()
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		if err := db.addSegment(); err != nil {
+			return err
+		}
+		db.active = db.segments.GetLast()
+		return nil
+	}
+
+	// In sparse mode closed segments come back with the index they were
+	// sealed with, and only the keys of the active segment are tracked.
+	sparse := db.segments.spill > 0
+	last := len(segments) - 1
+	for i, segment := range segments {
+		if i < last {
+			db.version++
+			segment.version = db.version
+			if sparse && segment.loadSparse(db.segments.spill) {
+				continue
+			}
+		}
+
+		f, err := os.OpenFile(segment.path, os.O_APPEND|os.O_RDWR, 0777)
+		if err != nil {
+			return err
+		}
+
+		offset, err := db.replay(f, segment, i == last || !sparse)
+		if err != nil && err != io.EOF {
+			f.Close()
+			return err
+		}
+
+		if i < last {
+			f.Close()
+			if err := segment.seal(db.segments.spill); err != nil {
+				return err
+			}
+			continue
+		}
+		db.out = f
+		db.offset = offset
+		db.active = segment
+	}
+
+	if sparse {
+		return db.countSealed(segments[:last])
+	}
+	return nil
+}
+
+// countSealed adds the live keys of the sealed segments to the statistics.
+// It walks their indexes instead of tracking every key.
+func (db *Db) countSealed(list []*Segment) error {
+	return walk(list, "", func(key string, s *Segment, pos int64) (bool, error) {
+		state, err := s.state(pos)
+		if err != nil {
+			return false, err
+		}
+		if !state.deleted {
+			db.liveKeys.Add(1)
+			db.liveBytes.Add(state.size)
+		}
+		return true, nil
+	})
+}
+
+// nextEpoch increments the open counter stored in the directory and returns
+// the new value. The file is replaced atomically like the manifest.
+func nextEpoch(dir string) (uint64, error) {
+	path := filepath.Join(dir, epochFileName)
+
+	var epoch uint64
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		epoch, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: epoch file", ErrCorrupted)
+		}
+	case !os.IsNotExist(err):
+		return 0, err
+	}
+	epoch++
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(epoch, 10)+"\n"), 0o600); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	return epoch, nil
+}
+
+// replay fills the index of the segment from its records. Tracked segments
+// record the state of every key as well.
+func (db *Db) replay(f *os.File, segment *Segment, track bool) (int64, error) {
 	var err error
+	var offset int64
 	var buf [bufferSize]byte
 
-	in := bufio.NewReaderSize(db.out, bufferSize)
+	in := bufio.NewReaderSize(f, bufferSize)
 	for err == nil {
 		var (
 			header []byte
@@ -123,10 +512,13 @@ func (db *Db) recover() error {
 
 		if err == io.EOF {
 			if len(header) == 0 {
-				return err
+				return offset, err
 			}
 		} else if err != nil {
-			return err
+			return offset, err
+		}
+		if len(header) < 12 {
+			return offset, fmt.Errorf("%w: corrupted file", ErrCorrupted)
 		}
 
 		size := binary.LittleEndian.Uint32(header)
@@ -137,24 +529,130 @@ func (db *Db) recover() error {
 			data = make([]byte, size)
 		}
 
-		n, err = in.Read(data)
+		n, err = io.ReadFull(in, data)
 		if err != nil {
-			return err
-		}
-
-		if n != int(size) {
-			return fmt.Errorf("corrupted file")
+			return offset, fmt.Errorf("%w: corrupted file", ErrCorrupted)
 		}
 
 		var e entry
 		e.Decode(data)
 
-		db.segments.GetLast().index[e.key] = db.offset
-		db.offset += int64(n)
+		if track {
+			db.version++
+			db.setState(e.key, keyState{
+				version: db.version,
+				size:    int64(n),
+				deleted: binary.LittleEndian.Uint32(data[8:])&tombstoneFlag != 0,
+			})
+		}
+
+		segment.index[e.key] = offset
+		if !segment.bloomSaved {
+			segment.bloom.Add(e.key)
+		}
+		offset += int64(n)
+	}
+	return offset, err
+}
+
+// Keys returns up to limit live keys greater than after in sorted order, so
+// a listing can be resumed from the last key it returned. A non-positive
+// limit returns all of them.
+func (db *Db) Keys(after string, limit int) ([]string, error) {
+	op := HashOperation{
+		after: after,
+		limit: limit,
+		keys:  make(chan keyList),
 	}
-	return err
+
+	if !db.query(op) {
+		return nil, ErrClosed
+	}
+	list := <-op.keys
+	return list.keys, list.err
+}
+
+// listKeys merges the sorted indexes of the segments from the key after on.
+func (db *Db) listKeys(after string, limit int) keyList {
+	keys := make([]string, 0)
+	err := walk(db.segments.snapshot(), after, func(key string, s *Segment, pos int64) (bool, error) {
+		state, ok := db.versions[key]
+		if !ok {
+			var err error
+			if state, err = s.state(pos); err != nil {
+				return false, err
+			}
+		}
+		if !state.deleted {
+			keys = append(keys, key)
+		}
+		return limit <= 0 || len(keys) < limit, nil
+	})
+	return keyList{keys, err}
+}
+
+// versionAt returns the version of the latest record of the key, which was
+// found in the segment.
+func (db *Db) versionAt(key string, s *Segment) uint64 {
+	if state, ok := db.versions[key]; ok {
+		return state.version
+	}
+	return s.version
+}
+
+// stateOf returns the latest record of the key, reading it from the sealed
+// segments when it is not tracked.
+func (db *Db) stateOf(key string) (keyState, bool) {
+	if state, ok := db.versions[key]; ok || db.segments.spill <= 0 {
+		return state, ok
+	}
+
+	s, pos, err := db.segments.Find(key)
+	if err != nil {
+		return keyState{}, false
+	}
+	state, err := s.state(pos)
+	if err != nil {
+		return keyState{}, false
+	}
+	return state, true
+}
+
+// activate switches the tracked keys to a new active segment. In sparse mode
+// the keys of the sealed one are dropped together with its in-memory index.
+func (db *Db) activate(s *Segment) {
+	db.active = s
+	if db.segments.spill > 0 {
+		db.versions = make(map[string]keyState)
+	}
+}
+
+// setState records the latest record of the key and keeps the live key and
+// byte counters in sync. It is called by the operations goroutine, or during
+// recovery before it starts, before the index points at the new record.
+func (db *Db) setState(key string, state keyState) {
+	if old, ok := db.stateOf(key); ok && !old.deleted {
+		db.liveKeys.Add(-1)
+		db.liveBytes.Add(-old.size)
+	}
+	if !state.deleted {
+		db.liveKeys.Add(1)
+		db.liveBytes.Add(state.size)
+	}
+	db.versions[key] = state
 }
 
+// Close finishes the write in progress, fails the queued ones with ErrClosed
+// and stops the goroutines of the database and a pending compaction.
 func (db *Db) Close() error {
+	db.closeOnce.Do(func() {
+		close(db.closing)
+		// The writer goes first, it waits on the operations goroutine.
+		<-db.closed
+		db.done.Wait()
+		db.segments.Close()
+	})
+
+	db.watchers.closeAll()
 	return db.out.Close()
 }
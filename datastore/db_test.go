@@ -1,9 +1,12 @@
 package datastore
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -193,4 +196,243 @@ func TestDatabaseChecksum(t *testing.T) {
 			t.Errorf("No expected error occured")
 		}
 	})
+
+	t.Run("Compaction is aborted", func(t *testing.T) {
+		path := filepath.Join(dir, "merged")
+		if _, err := db.segments.merge(path, db.segments.snapshot()); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected the corrupted record to abort the merge, got %v", err)
+		}
+	})
+}
+
+func TestDatabaseDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal("Delete operation failed:", err)
+	}
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+	}
+
+	t.Run("Deletion survives reopening", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 250)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := db.Get("key1"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+		}
+		if value, err := db.Get("key2"); err != nil || value != "value2" {
+			t.Errorf("Value mismatch for key2: got %s (%v)", value, err)
+		}
+	})
+}
+
+func TestDatabaseBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var pairs []KeyValue
+	for i := 0; i < 30; i++ {
+		pairs = append(pairs, KeyValue{Key: fmt.Sprintf("key%02d", i), Value: fmt.Sprintf("value%d", i)})
+	}
+	if err := db.PutBatch(pairs); err != nil {
+		t.Fatal("PutBatch operation failed:", err)
+	}
+	db.Delete("key05")
+
+	for _, kv := range pairs {
+		value, err := db.Get(kv.Key)
+		if kv.Key == "key05" {
+			if err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+			}
+			continue
+		}
+		if err != nil || value != kv.Value {
+			t.Errorf("Value mismatch for key %s: expected %s, got %s (%v)", kv.Key, kv.Value, value, err)
+		}
+	}
+
+	t.Run("Keys are listed in pages", func(t *testing.T) {
+		var listed []string
+		after := ""
+		for {
+			keys, err := db.Keys(after, 7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) == 0 {
+				break
+			}
+			listed = append(listed, keys...)
+			after = keys[len(keys)-1]
+		}
+
+		if len(listed) != len(pairs)-1 {
+			t.Fatalf("Expected %d keys, got %d", len(pairs)-1, len(listed))
+		}
+		for i := 1; i < len(listed); i++ {
+			if listed[i-1] >= listed[i] || listed[i] == "key05" {
+				t.Errorf("Unexpected key %s after %s", listed[i], listed[i-1])
+			}
+		}
+	})
+
+	t.Run("Listing sees keys added since the last one", func(t *testing.T) {
+		if err := db.Put("key10a", "value"); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := db.Keys("key10", 1)
+		if err != nil || len(keys) != 1 || keys[0] != "key10a" {
+			t.Errorf("Expected key10a after key10, got %v (%v)", keys, err)
+		}
+	})
+}
+
+func TestDatabaseLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, 250, Options{MaxKeySize: 8, MaxValueSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal("Put within the limits failed:", err)
+	}
+	if err := db.Put("", "value"); err != ErrEmptyKey {
+		t.Errorf("Expected ErrEmptyKey, got %v", err)
+	}
+	if err := db.Put("too-long-key", "value"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := db.Put("key", "value that is too long"); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+
+	txn := db.Begin()
+	if err := txn.Put("key", "value that is too long"); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge from a transaction, got %v", err)
+	}
+	txn.Discard()
+
+	if value, _ := db.Get("key"); value != "value" {
+		t.Errorf("Rejected writes changed the value: %s", value)
+	}
+}
+
+func TestDatabaseOverload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, 250, Options{WriteQueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The writer blocks handing back the result of an empty element nobody
+	// waits for, so the queue stays full until it is received.
+	blocker := EntryElement{err: make(chan error)}
+	db.ops <- blocker
+	for len(db.ops) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queued := []EntryElement{{err: make(chan error)}, {err: make(chan error)}}
+	for _, ee := range queued {
+		db.ops <- ee
+	}
+
+	if err := db.Put("key", "value"); err != ErrOverloaded {
+		t.Fatalf("Expected ErrOverloaded, got %v", err)
+	}
+	if stats := db.Stats(); stats.QueuedWrites != 2 || stats.RejectedWrites != 1 {
+		t.Errorf("Unexpected queue stats: %d queued, %d rejected", stats.QueuedWrites, stats.RejectedWrites)
+	}
+
+	<-blocker.err
+	for _, ee := range queued {
+		<-ee.err
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Errorf("Put failed once the queue drained: %v", err)
+	}
+}
+
+func TestDatabaseClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	goroutines := runtime.NumGoroutine()
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough rollovers to schedule a compaction.
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.segments.compaction == nil {
+		t.Fatal("No compaction was scheduled")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("key", "value"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from Put, got %v", err)
+	}
+	if _, err := db.Get("key0"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from Get, got %v", err)
+	}
+
+	// The scheduled compaction was cancelled.
+	time.Sleep(2 * compactionDelay)
+	if n := db.segments.compactions.Load(); n != 0 {
+		t.Errorf("%d compactions ran after Close", n)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines left running after Close", n-goroutines)
+	}
 }
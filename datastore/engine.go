@@ -0,0 +1,49 @@
+package datastore
+
+import "fmt"
+
+// Names of the engines OpenEngine knows.
+const (
+	HashEngine = "hash"
+	LSMEngine  = "lsm"
+)
+
+// Engine is a key-value storage engine. Db, the append-only hash log, and
+// LSM, the log-structured merge tree, both implement it.
+type Engine interface {
+	Get(key string) (string, error)
+	// GetMany returns the values of the keys that are found and the keys
+	// that are not, read from one consistent view of the data.
+	GetMany(keys []string) (map[string]string, []string, error)
+	Put(key, value string) error
+	Delete(key string) error
+	Close() error
+}
+
+var (
+	_ Engine = (*Db)(nil)
+	_ Engine = (*LSM)(nil)
+)
+
+// OpenEngine opens the named engine in the directory. The segment size and
+// the index options only apply to the hash engine, the size limits to both.
+func OpenEngine(name, dir string, segmentSize int64, opts Options) (Engine, error) {
+	switch name {
+	case HashEngine:
+		db, err := NewDbWithOptions(dir, segmentSize, opts)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case LSMEngine:
+		db, err := NewLSM(dir, LSMOptions{
+			MaxKeySize:   opts.MaxKeySize,
+			MaxValueSize: opts.MaxValueSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	}
+	return nil, fmt.Errorf("unknown engine %q", name)
+}
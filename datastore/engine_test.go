@@ -0,0 +1,213 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// testEngine is the conformance suite every Engine implementation must pass.
+func testEngine(t *testing.T, open func(dir string) (Engine, error)) {
+	dir, err := ioutil.TempDir("", "engine-testing")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine, err := open(dir)
+	if err != nil {
+		t.Fatal("Failed to open engine:", err)
+	}
+	defer func() {
+		engine.Close()
+	}()
+
+	expected := make(map[string]string)
+
+	t.Run("Put and get", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+			if err := engine.Put(key, value); err != nil {
+				t.Fatalf("Put operation failed for key %s: %v", key, err)
+			}
+			expected[key] = value
+		}
+		for key, value := range expected {
+			if got, err := engine.Get(key); err != nil || got != value {
+				t.Errorf("Value mismatch for key %s: expected %s, got %s (%v)", key, value, got, err)
+			}
+		}
+	})
+
+	t.Run("Missing key", func(t *testing.T) {
+		if _, err := engine.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		if err := engine.Put("key1", "updated"); err != nil {
+			t.Fatal(err)
+		}
+		expected["key1"] = "updated"
+		if got, _ := engine.Get("key1"); got != "updated" {
+			t.Errorf("Expected updated value, got %s", got)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := engine.Delete("key2"); err != nil {
+			t.Fatal(err)
+		}
+		delete(expected, "key2")
+		if _, err := engine.Get("key2"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+		}
+		if err := engine.Delete("never-written"); err != nil {
+			t.Errorf("Deleting a missing key failed: %v", err)
+		}
+	})
+
+	t.Run("Many keys", func(t *testing.T) {
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("many%d", i%700)
+			value := fmt.Sprintf("value%d", i)
+			if i%11 == 0 {
+				if err := engine.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(expected, key)
+				continue
+			}
+			if err := engine.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			expected[key] = value
+		}
+		// Let background compaction and merges run.
+		time.Sleep(500 * time.Millisecond)
+
+		checkEngine(t, engine, expected)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		if err := engine.Close(); err != nil {
+			t.Fatal("Failed to close engine:", err)
+		}
+		engine, err = open(dir)
+		if err != nil {
+			t.Fatal("Failed to reopen engine:", err)
+		}
+
+		checkEngine(t, engine, expected)
+		if _, err := engine.Get("key2"); err != ErrNotFound {
+			t.Errorf("Deleted key is back after reopening: %v", err)
+		}
+	})
+}
+
+func checkEngine(t *testing.T, engine Engine, expected map[string]string) {
+	keys := []string{"missing"}
+	for key, value := range expected {
+		if got, err := engine.Get(key); err != nil || got != value {
+			t.Errorf("Value mismatch for key %s: expected %s, got %s (%v)", key, value, got, err)
+		}
+		keys = append(keys, key)
+	}
+
+	values, missing, err := engine.GetMany(keys)
+	if err != nil {
+		t.Fatal("GetMany operation failed:", err)
+	}
+	if len(values) != len(expected) || len(missing) != 1 || missing[0] != "missing" {
+		t.Errorf("GetMany found %d of %d keys, missing %v", len(values), len(expected), missing)
+	}
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("GetMany value mismatch for key %s: expected %s, got %s", key, value, values[key])
+		}
+	}
+	for i := 0; i < 700; i++ {
+		key := fmt.Sprintf("many%d", i)
+		if _, ok := expected[key]; ok {
+			continue
+		}
+		if _, err := engine.Get(key); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for key %s, got %v", key, err)
+		}
+	}
+}
+
+func TestDbEngine(t *testing.T) {
+	testEngine(t, func(dir string) (Engine, error) {
+		return NewDb(dir, 4096)
+	})
+}
+
+func TestDbSparseEngine(t *testing.T) {
+	testEngine(t, func(dir string) (Engine, error) {
+		return NewDbWithOptions(dir, 4096, Options{Index: SparseIndexMode})
+	})
+}
+
+func TestLSMEngine(t *testing.T) {
+	testEngine(t, func(dir string) (Engine, error) {
+		return NewLSM(dir, LSMOptions{
+			MemtableSize: 2048,
+			TableSize:    4096,
+			L0Tables:     2,
+			LevelSize:    8192,
+		})
+	})
+}
+
+func TestEngineLimits(t *testing.T) {
+	for _, name := range []string{HashEngine, LSMEngine} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "engine-testing")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			engine, err := OpenEngine(name, dir, 4096, Options{MaxKeySize: 8, MaxValueSize: 16})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer engine.Close()
+			batch := engine.(interface {
+				PutBatch(pairs []KeyValue) error
+			})
+
+			if err := engine.Put("key", "value"); err != nil {
+				t.Fatal("Put within the limits failed:", err)
+			}
+			if err := engine.Put("", "value"); err != ErrEmptyKey {
+				t.Errorf("Expected ErrEmptyKey, got %v", err)
+			}
+			if err := engine.Delete(""); err != ErrEmptyKey {
+				t.Errorf("Expected ErrEmptyKey from Delete, got %v", err)
+			}
+			if err := engine.Put("too-long-key", "value"); !errors.Is(err, ErrKeyTooLarge) {
+				t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+			}
+			if err := engine.Put("key", "value that is too long"); !errors.Is(err, ErrValueTooLarge) {
+				t.Errorf("Expected ErrValueTooLarge, got %v", err)
+			}
+			err = batch.PutBatch([]KeyValue{{Key: "other", Value: "value"}, {Key: "key", Value: "value that is too long"}})
+			if !errors.Is(err, ErrValueTooLarge) {
+				t.Errorf("Expected ErrValueTooLarge from PutBatch, got %v", err)
+			}
+
+			if value, _ := engine.Get("key"); value != "value" {
+				t.Errorf("Rejected writes changed the value: %s", value)
+			}
+			if _, err := engine.Get("other"); err != ErrNotFound {
+				t.Errorf("A rejected batch was partly written: %v", err)
+			}
+		})
+	}
+}
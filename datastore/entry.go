@@ -5,16 +5,29 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"io"
 )
 
+// tombstoneFlag is set in the value length field of an entry that records
+// the deletion of its key.
+const tombstoneFlag = 1 << 31
+
 type entry struct {
 	key, value string
 	checksum   []byte
 }
 
 func (e *entry) Encode() []byte {
+	return e.encode(0)
+}
+
+// EncodeTombstone encodes a deletion marker for the entry's key.
+func (e *entry) EncodeTombstone() []byte {
+	return (&entry{key: e.key}).encode(tombstoneFlag)
+}
+
+func (e *entry) encode(flags uint32) []byte {
 	kl := len(e.key)
 	vl := len(e.value)
 
@@ -28,7 +41,7 @@ func (e *entry) Encode() []byte {
 	copy(res[kl+12:], e.value)
 	data := make([]byte, size-20)
 
-	binary.LittleEndian.PutUint32(res[8:], uint32(vl))
+	binary.LittleEndian.PutUint32(res[8:], uint32(vl)|flags)
 
 	copy(data, res[:size-19])
 	sum := sha1.Sum(data)
@@ -43,7 +56,7 @@ func (e *entry) Length() int64 {
 
 func (e *entry) Decode(input []byte) {
 	kl := binary.LittleEndian.Uint32(input[4:])
-	vl := binary.LittleEndian.Uint32(input[8:])
+	vl := binary.LittleEndian.Uint32(input[8:]) &^ tombstoneFlag
 
 	key := make([]byte, kl)
 	copy(key, input[12:kl+12])
@@ -59,47 +72,69 @@ func (e *entry) Decode(input []byte) {
 	copy(e.checksum, input[kl+vl+12:])
 }
 
+// readValue reads the value of the record at the reader position. Records
+// that fail the checksum or end early are reported as ErrCorrupted.
 func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(12)
-	if err != nil {
-		return "", err
+	e, deleted, err := readRecord(in)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("%w: truncated record", ErrCorrupted)
 	}
-
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	valSize := int(binary.LittleEndian.Uint32(header[8:]))
-
-	data, err := in.Peek(12 + keySize + valSize)
 	if err != nil {
 		return "", err
 	}
 
-	_, err = in.Discard(12 + keySize)
-	if err != nil {
-		return "", err
+	if deleted {
+		return "", ErrNotFound
 	}
+	return e.value, nil
+}
+
+// readRecord reads the whole record at the reader position, verifies its
+// checksum and reports whether it is a tombstone.
+func readRecord(in *bufio.Reader) (entry, bool, error) {
+	var e entry
 
-	value, err := in.Peek(valSize)
+	header, err := in.Peek(12)
 	if err != nil {
-		return "", err
+		if err == io.EOF && len(header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return e, false, err
 	}
 
-	if len(value) != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", len(value), valSize)
+	keySize := int(binary.LittleEndian.Uint32(header[4:]))
+	valField := binary.LittleEndian.Uint32(header[8:])
+	valSize := int(valField &^ tombstoneFlag)
+
+	data := make([]byte, 12+keySize+valSize+20)
+	if _, err := io.ReadFull(in, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return e, false, err
 	}
 
-	_, err = in.Discard(valSize)
-	if err != nil {
-		return "", err
+	sum := sha1.Sum(data[:12+keySize+valSize])
+	if !bytes.Equal(sum[:], data[12+keySize+valSize:]) {
+		return e, false, ErrCorrupted
 	}
 
-	sum, err := in.Peek(20)
-	if err != nil {
-		return "", err
-	}
-	realSum := sha1.Sum(data)
-	if bytes.Compare(sum, realSum[:]) != 0 {
-		return "", errors.New("entry's checksum is wrong")
+	e.Decode(data)
+	return e, valField&tombstoneFlag != 0, nil
+}
+
+// readHeaderAt reports the size of the record at pos and whether it is a
+// tombstone without reading the rest of it.
+func readHeaderAt(r io.ReaderAt, pos int64) (int64, bool, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, pos); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("%w: truncated record", ErrCorrupted)
+		}
+		return 0, false, err
 	}
 
-	return string(value), nil
+	size := binary.LittleEndian.Uint32(header)
+	deleted := binary.LittleEndian.Uint32(header[8:])&tombstoneFlag != 0
+	return int64(size), deleted, nil
 }
@@ -0,0 +1,346 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	indexSuffix           = ".index"
+	defaultSparseInterval = 16
+)
+
+type IndexMode int
+
+const (
+	// HashIndexMode keeps the offsets of every key of every segment in memory.
+	HashIndexMode IndexMode = iota
+	// SparseIndexMode keeps only the active segment's index in memory. Closed
+	// segments get a sorted index file next to them and only every
+	// SparseInterval-th key of it stays in memory.
+	SparseIndexMode
+)
+
+type sparseSample struct {
+	key string
+	pos int64
+}
+
+// SparseIndex is the in-memory summary of a sorted on-disk key index. Each
+// record of the file is the key length (4 bytes), the key and the record
+// offset in the segment (8 bytes); samples point at every n-th record, so a
+// lookup reads a single block between two samples.
+type SparseIndex struct {
+	path    string
+	size    int64
+	keys    int
+	last    string
+	samples []sparseSample
+}
+
+// sparseIndexWriter streams records, added in sorted key order, into an
+// index file and collects the samples of the resulting SparseIndex.
+type sparseIndexWriter struct {
+	f        *os.File
+	out      *bufio.Writer
+	interval int
+	index    *SparseIndex
+}
+
+// newSparseIndexWriter writes to a temporary file that replaces the index on
+// Close, so a saved index is always complete.
+func newSparseIndexWriter(segmentPath string, interval int) (*sparseIndexWriter, error) {
+	path := segmentPath + indexSuffix
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sparseIndexWriter{
+		f:        f,
+		out:      bufio.NewWriter(f),
+		interval: interval,
+		index:    &SparseIndex{path: path},
+	}, nil
+}
+
+func (w *sparseIndexWriter) Add(key string, pos int64) error {
+	si := w.index
+	if si.keys%w.interval == 0 {
+		si.samples = append(si.samples, sparseSample{key: key, pos: si.size})
+	}
+
+	record := make([]byte, 12+len(key))
+	binary.LittleEndian.PutUint32(record, uint32(len(key)))
+	copy(record[4:], key)
+	binary.LittleEndian.PutUint64(record[4+len(key):], uint64(pos))
+
+	n, err := w.out.Write(record)
+	if err != nil {
+		return err
+	}
+	si.size += int64(n)
+	si.keys++
+	si.last = key
+	return nil
+}
+
+func (w *sparseIndexWriter) Close() (*SparseIndex, error) {
+	if err := w.out.Flush(); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	if err := w.f.Close(); err != nil {
+		return nil, err
+	}
+	return w.index, os.Rename(w.f.Name(), w.index.path)
+}
+
+// abort drops an index that could not be completed.
+func (w *sparseIndexWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// writeSparseIndex stores the index sorted by key next to the segment file.
+func writeSparseIndex(segmentPath string, index HashIndex, interval int) (*SparseIndex, error) {
+	w, err := newSparseIndexWriter(segmentPath, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range sortedKeys(index) {
+		if err := w.Add(key, index[key]); err != nil {
+			w.abort()
+			return nil, err
+		}
+	}
+	return w.Close()
+}
+
+// loadSparseIndex rebuilds the samples of an index file written earlier.
+func loadSparseIndex(path string, interval int) (*SparseIndex, error) {
+	si := &SparseIndex{path: path}
+	it, err := si.Iterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	for {
+		key, _, ok, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return si, nil
+		}
+
+		if si.keys%interval == 0 {
+			si.samples = append(si.samples, sparseSample{key: key, pos: si.size})
+		}
+		si.size += int64(12 + len(key))
+		si.keys++
+		si.last = key
+	}
+}
+
+func sortedKeys(index HashIndex) []string {
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sample returns the last sample at or before the key, -1 if there is none.
+func (si *SparseIndex) sample(key string) int {
+	return sort.Search(len(si.samples), func(i int) bool {
+		return si.samples[i].key > key
+	}) - 1
+}
+
+// Find binary searches the samples and scans the block that may hold the key.
+func (si *SparseIndex) Find(key string) (int64, bool, error) {
+	i := si.sample(key)
+	if i < 0 {
+		return 0, false, nil
+	}
+
+	end := si.size
+	if i+1 < len(si.samples) {
+		end = si.samples[i+1].pos
+	}
+
+	f, err := os.Open(si.path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	block := make([]byte, end-si.samples[i].pos)
+	if _, err := f.ReadAt(block, si.samples[i].pos); err != nil {
+		return 0, false, err
+	}
+
+	for len(block) > 0 {
+		k, pos, n, err := decodeIndexRecord(block)
+		if err != nil {
+			return 0, false, err
+		}
+		if k == key {
+			return pos, true, nil
+		}
+		if k > key {
+			break
+		}
+		block = block[n:]
+	}
+	return 0, false, nil
+}
+
+// indexIterator walks the records of a segment index in sorted key order.
+type indexIterator interface {
+	Next() (key string, pos int64, ok bool, err error)
+	Close() error
+}
+
+type sparseIterator struct {
+	f      *os.File
+	in     *bufio.Reader
+	header []byte
+}
+
+func (si *SparseIndex) Iterator() (indexIterator, error) {
+	f, err := os.Open(si.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sparseIterator{
+		f:      f,
+		in:     bufio.NewReader(f),
+		header: make([]byte, 4),
+	}, nil
+}
+
+// IteratorAfter starts at the first key greater than after, reading from the
+// block that may hold it.
+func (si *SparseIndex) IteratorAfter(after string) (indexIterator, error) {
+	var start int64
+	if i := si.sample(after); i >= 0 {
+		start = si.samples[i].pos
+	}
+
+	f, err := os.Open(si.path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &afterIterator{
+		indexIterator: &sparseIterator{
+			f:      f,
+			in:     bufio.NewReader(f),
+			header: make([]byte, 4),
+		},
+		after: after,
+	}, nil
+}
+
+func (it *sparseIterator) Next() (string, int64, bool, error) {
+	if _, err := io.ReadFull(it.in, it.header); err == io.EOF {
+		return "", 0, false, nil
+	} else if err != nil {
+		return "", 0, false, err
+	}
+
+	record := make([]byte, 4+binary.LittleEndian.Uint32(it.header)+8)
+	copy(record, it.header)
+	if _, err := io.ReadFull(it.in, record[4:]); err != nil {
+		return "", 0, false, err
+	}
+
+	key, pos, _, err := decodeIndexRecord(record)
+	if err != nil {
+		return "", 0, false, err
+	}
+	return key, pos, true, nil
+}
+
+func (it *sparseIterator) Close() error {
+	return it.f.Close()
+}
+
+// hashIterator walks a snapshot of an in-memory index.
+type hashIterator struct {
+	keys  []string
+	index HashIndex
+}
+
+// newHashIterator walks the keys greater than after, given all keys of the
+// index in sorted order.
+func newHashIterator(hi HashIndex, keys []string, after string) indexIterator {
+	i := sort.Search(len(keys), func(i int) bool {
+		return keys[i] > after
+	})
+
+	return &hashIterator{
+		keys:  keys[i:],
+		index: hi,
+	}
+}
+
+func (it *hashIterator) Next() (string, int64, bool, error) {
+	if len(it.keys) == 0 {
+		return "", 0, false, nil
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	return key, it.index[key], true, nil
+}
+
+func (it *hashIterator) Close() error {
+	return nil
+}
+
+// afterIterator skips the records up to and including the key after.
+type afterIterator struct {
+	indexIterator
+	after string
+}
+
+func (it *afterIterator) Next() (string, int64, bool, error) {
+	for {
+		key, pos, ok, err := it.indexIterator.Next()
+		if err != nil || !ok || key > it.after {
+			return key, pos, ok, err
+		}
+	}
+}
+
+func decodeIndexRecord(data []byte) (string, int64, int, error) {
+	if len(data) < 4 {
+		return "", 0, 0, fmt.Errorf("corrupted index record")
+	}
+	kl := int(binary.LittleEndian.Uint32(data))
+	if len(data) < 12+kl {
+		return "", 0, 0, fmt.Errorf("corrupted index record")
+	}
+
+	key := string(data[4 : 4+kl])
+	pos := int64(binary.LittleEndian.Uint64(data[4+kl:]))
+	return key, pos, 12 + kl, nil
+}
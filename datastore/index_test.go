@@ -0,0 +1,208 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := make(HashIndex)
+	for i := 0; i < 100; i++ {
+		index[fmt.Sprintf("key%03d", i)] = int64(i * 42)
+	}
+
+	si, err := writeSparseIndex(filepath.Join(dir, "segment"), index, 8)
+	if err != nil {
+		t.Fatal("Failed to write sparse index:", err)
+	}
+	if len(si.samples) != 13 {
+		t.Errorf("Expected 13 samples, got %d", len(si.samples))
+	}
+
+	for key, expected := range index {
+		pos, ok, err := si.Find(key)
+		if err != nil || !ok {
+			t.Fatalf("Key %s not found: %v", key, err)
+		}
+		if pos != expected {
+			t.Errorf("Position mismatch for key %s: expected %d, got %d", key, expected, pos)
+		}
+	}
+
+	for _, key := range []string{"a", "key0005", "key050a", "zzz"} {
+		if _, ok, err := si.Find(key); ok || err != nil {
+			t.Errorf("Unexpected result for missing key %s: %t, %v", key, ok, err)
+		}
+	}
+
+	t.Run("Iterator", func(t *testing.T) {
+		it, err := si.Iterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+
+		count, prev := 0, ""
+		for {
+			key, pos, ok, err := it.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			if key <= prev || index[key] != pos {
+				t.Errorf("Unexpected record %s at %d after %s", key, pos, prev)
+			}
+			count, prev = count+1, key
+		}
+		if count != len(index) {
+			t.Errorf("Expected %d records, got %d", len(index), count)
+		}
+	})
+}
+
+func TestDatabaseSparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, 200, Options{Index: SparseIndexMode, SparseInterval: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key%d", i%25)
+		value := fmt.Sprintf("value%d", i)
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	db.Delete("key3")
+	delete(expected, "key3")
+	time.Sleep(500 * time.Millisecond)
+
+	t.Run("Only the active segment is in memory", func(t *testing.T) {
+		list := db.segments.snapshot()
+		for _, s := range list[:len(list)-1] {
+			if s.index != nil || s.sparse == nil {
+				t.Errorf("Closed segment %s keeps its index in memory", s.path)
+			}
+		}
+		if list[len(list)-1].index == nil {
+			t.Errorf("Active segment has no in-memory index")
+		}
+	})
+
+	t.Run("Values are found", func(t *testing.T) {
+		for key, value := range expected {
+			got, err := db.Get(key)
+			if err != nil || got != value {
+				t.Errorf("Value mismatch for key %s: expected %s, got %s (%v)", key, value, got, err)
+			}
+		}
+		if _, err := db.Get("key3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for deleted key, got %v", err)
+		}
+	})
+
+	t.Run("Saved indexes are loaded on restart", func(t *testing.T) {
+		stats := db.Stats()
+		if stats.Keys != int64(len(expected)) {
+			t.Errorf("Expected %d keys, got %d", len(expected), stats.Keys)
+		}
+		list := db.segments.snapshot()
+		saved, err := os.Stat(list[0].path + indexSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions(dir, 200, Options{Index: SparseIndexMode, SparseInterval: 4})
+		if err != nil {
+			t.Fatal("Failed to reopen database:", err)
+		}
+
+		list = db.segments.snapshot()
+		if list[0].sparse == nil {
+			t.Fatalf("Closed segment %s has no spilled index", list[0].path)
+		}
+		if loaded, err := os.Stat(list[0].sparse.path); err != nil || !os.SameFile(saved, loaded) {
+			t.Errorf("Index of %s was rebuilt instead of loaded", list[0].path)
+		}
+		if active := list[len(list)-1]; len(db.versions) > len(active.index) {
+			t.Errorf("Keys of closed segments are kept in memory: %d tracked", len(db.versions))
+		}
+
+		for key, value := range expected {
+			got, err := db.Get(key)
+			if err != nil || got != value {
+				t.Errorf("Value mismatch for key %s: expected %s, got %s (%v)", key, value, got, err)
+			}
+		}
+		if _, version, err := db.GetVersioned("key3"); err != ErrNotFound || version == 0 {
+			t.Errorf("Expected a versioned ErrNotFound for deleted key, got %d (%v)", version, err)
+		}
+		if keys, err := db.Keys("", 0); err != nil || len(keys) != len(expected) {
+			t.Errorf("Expected %d keys, got %d (%v)", len(expected), len(keys), err)
+		}
+		if got := db.Stats(); got.Keys != stats.Keys || got.LiveBytes != stats.LiveBytes {
+			t.Errorf("Statistics changed over a restart: %d keys in %d bytes, was %d in %d", got.Keys, got.LiveBytes, stats.Keys, stats.LiveBytes)
+		}
+	})
+}
+
+func benchmarkGet(b *testing.B, opts Options) {
+	dir, err := ioutil.TempDir("", "db-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, 64*1024, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i*7919%keys)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetHashIndex(b *testing.B) {
+	benchmarkGet(b, Options{})
+}
+
+func BenchmarkGetSparseIndex(b *testing.B) {
+	benchmarkGet(b, Options{Index: SparseIndexMode})
+}
@@ -0,0 +1,659 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	walFileName      = "wal"
+	manifestFileName = "MANIFEST"
+	lsmMaxLevels     = 7
+)
+
+// LSMOptions tune an LSM engine. Zero fields take the defaults.
+type LSMOptions struct {
+	// MemtableSize is the WAL size at which the memtable is flushed to L0.
+	MemtableSize int64
+	// TableSize is the target size of the tables produced by merges.
+	TableSize int64
+	// L0Tables is the number of L0 tables that triggers a merge into L1.
+	L0Tables int
+	// LevelSize is the size limit of L1, every next level holds ten times more.
+	LevelSize int64
+
+	// Limits of writes in bytes, as in Options.
+	MaxKeySize   int
+	MaxValueSize int
+}
+
+func (o *LSMOptions) setDefaults() {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = 1 << 20
+	}
+	if o.TableSize <= 0 {
+		o.TableSize = 2 << 20
+	}
+	if o.L0Tables <= 0 {
+		o.L0Tables = 4
+	}
+	if o.LevelSize <= 0 {
+		o.LevelSize = 10 << 20
+	}
+	if o.MaxKeySize <= 0 {
+		o.MaxKeySize = DefaultMaxKeySize
+	}
+	if o.MaxValueSize <= 0 {
+		o.MaxValueSize = DefaultMaxValueSize
+	}
+}
+
+type memValue struct {
+	value   string
+	deleted bool
+}
+
+// LSM is a log-structured merge tree. Writes go to the WAL and an in-memory
+// table that is flushed into a sorted table on L0 once it grows too big. L0
+// tables may overlap; a background merge moves them into L1 and keeps every
+// deeper level within its size limit, where tables have disjoint key ranges.
+type LSM struct {
+	dir  string
+	opts LSMOptions
+
+	mu      sync.RWMutex
+	wal     *os.File
+	mem     map[string]memValue
+	memSize int64
+	// levels[0] is ordered from oldest to newest, deeper levels by key.
+	levels  [lsmMaxLevels][]*sstable
+	nextNum uint64
+
+	merges  chan struct{}
+	closing chan struct{}
+	done    sync.WaitGroup
+}
+
+func NewLSM(dir string, opts LSMOptions) (*LSM, error) {
+	opts.setDefaults()
+	l := &LSM{
+		dir:     dir,
+		opts:    opts,
+		mem:     make(map[string]memValue),
+		nextNum: 1,
+		merges:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+	}
+
+	if err := l.loadManifest(); err != nil {
+		return nil, err
+	}
+	if err := l.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	l.done.Add(1)
+	go l.mergeLoop()
+	l.scheduleMerge()
+
+	return l, nil
+}
+
+func (l *LSM) Get(key string) (string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.get(key)
+}
+
+// GetMany returns the values of the keys that are found and the keys that
+// are not, all read under the same view of the memtable and the levels.
+func (l *LSM) GetMany(keys []string) (map[string]string, []string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	values := make(map[string]string, len(keys))
+	missing := make([]string, 0)
+	for _, key := range keys {
+		value, err := l.get(key)
+		if err == ErrNotFound {
+			missing = append(missing, key)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		values[key] = value
+	}
+	return values, missing, nil
+}
+
+// get looks the key up from the newest data to the oldest. The caller holds
+// l.mu.
+func (l *LSM) get(key string) (string, error) {
+	if v, ok := l.mem[key]; ok {
+		if v.deleted {
+			return "", ErrNotFound
+		}
+		return v.value, nil
+	}
+
+	for i := len(l.levels[0]) - 1; i >= 0; i-- {
+		if value, ok, err := l.levels[0][i].get(key); ok || err != nil {
+			return value, err
+		}
+	}
+
+	for level := 1; level < lsmMaxLevels; level++ {
+		tables := l.levels[level]
+		i := sort.Search(len(tables), func(i int) bool {
+			return tables[i].last >= key
+		})
+		if i == len(tables) {
+			continue
+		}
+		if value, ok, err := tables[i].get(key); ok || err != nil {
+			return value, err
+		}
+	}
+
+	return "", ErrNotFound
+}
+
+func (l *LSM) Put(key, value string) error {
+	return l.write(entry{key: key, value: value}, false)
+}
+
+func (l *LSM) Delete(key string) error {
+	return l.write(entry{key: key}, true)
+}
+
+// PutBatch appends all pairs to the WAL with a single write. A pair over the
+// size limits fails the whole batch.
+func (l *LSM) PutBatch(pairs []KeyValue) error {
+	var data []byte
+	for _, kv := range pairs {
+		e := entry{key: kv.Key, value: kv.Value}
+		if err := checkLimits(e, l.opts.MaxKeySize, l.opts.MaxValueSize); err != nil {
+			return err
+		}
+		data = append(data, e.Encode()...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.wal.Write(data); err != nil {
+		return err
+	}
+	for _, kv := range pairs {
+		l.mem[kv.Key] = memValue{value: kv.Value}
+	}
+	return l.grow(int64(len(data)))
+}
+
+func (l *LSM) write(e entry, deleted bool) error {
+	if err := checkLimits(e, l.opts.MaxKeySize, l.opts.MaxValueSize); err != nil {
+		return err
+	}
+
+	var data []byte
+	if deleted {
+		data = e.EncodeTombstone()
+	} else {
+		data = e.Encode()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.wal.Write(data); err != nil {
+		return err
+	}
+	l.mem[e.key] = memValue{value: e.value, deleted: deleted}
+	return l.grow(int64(len(data)))
+}
+
+// grow accounts for bytes appended to the WAL and flushes the memtable when
+// it gets too big. The caller holds l.mu.
+func (l *LSM) grow(size int64) error {
+	l.memSize += size
+
+	if l.memSize >= l.opts.MemtableSize {
+		return l.flush()
+	}
+	return nil
+}
+
+// flush writes the memtable into a new L0 table and resets the WAL. The
+// caller holds l.mu.
+func (l *LSM) flush() error {
+	if len(l.mem) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(l.mem))
+	for key := range l.mem {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w, err := newSSTableWriter(l.dir, l.nextNum, len(keys))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		v := l.mem[key]
+		if err := w.add(entry{key: key, value: v.value}, v.deleted); err != nil {
+			w.abort()
+			return err
+		}
+	}
+	t, err := w.finish()
+	if err != nil {
+		return err
+	}
+
+	l.nextNum++
+	l.levels[0] = append(l.levels[0], t)
+	if err := l.writeManifest(); err != nil {
+		return err
+	}
+
+	// The table is durable now, so the WAL can start over.
+	if err := l.wal.Truncate(0); err != nil {
+		return err
+	}
+	l.mem = make(map[string]memValue)
+	l.memSize = 0
+
+	l.scheduleMerge()
+	return nil
+}
+
+// Close stops background merges and closes the WAL. The memtable is not
+// flushed, it is restored from the WAL on the next start.
+func (l *LSM) Close() error {
+	close(l.closing)
+	l.done.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.wal.Close()
+}
+
+func (l *LSM) replayWAL() error {
+	f, err := os.OpenFile(filepath.Join(l.dir, walFileName), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	l.wal = f
+
+	var offset int64
+	in := bufio.NewReader(f)
+	for {
+		e, deleted, err := readRecord(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A torn record at the tail is the write that was in flight
+			// when the process stopped, it was never acknowledged.
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		l.mem[e.key] = memValue{value: e.value, deleted: deleted}
+		size := int64(len(e.key) + len(e.value) + 32)
+		offset += size
+		l.memSize += size
+	}
+	return nil
+}
+
+// The manifest lists the live tables, one "<level> <number>" line each. It
+// is replaced atomically, so tables left over by an interrupted flush or
+// merge are not picked up and get removed on start.
+func (l *LSM) writeManifest() error {
+	var b strings.Builder
+	for level, tables := range l.levels {
+		for _, t := range tables {
+			fmt.Fprintf(&b, "%d %d\n", level, t.num)
+		}
+	}
+
+	path := filepath.Join(l.dir, manifestFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (l *LSM) loadManifest() error {
+	data, err := os.ReadFile(filepath.Join(l.dir, manifestFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	live := make(map[uint64]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var (
+			level int
+			num   uint64
+		)
+		if _, err := fmt.Sscanf(line, "%d %d", &level, &num); err != nil || level < 0 || level >= lsmMaxLevels {
+			return fmt.Errorf("corrupted manifest line %q", line)
+		}
+
+		t, err := openSSTable(l.dir, num)
+		if err != nil {
+			return err
+		}
+		l.levels[level] = append(l.levels[level], t)
+		live[num] = true
+		if num >= l.nextNum {
+			l.nextNum = num + 1
+		}
+	}
+
+	sort.Slice(l.levels[0], func(i, j int) bool {
+		return l.levels[0][i].num < l.levels[0][j].num
+	})
+	for level := 1; level < lsmMaxLevels; level++ {
+		sortByKey(l.levels[level])
+	}
+
+	files, err := filepath.Glob(filepath.Join(l.dir, "*"+sstSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		var num uint64
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d"+sstSuffix, &num); err != nil {
+			continue
+		}
+		if !live[num] {
+			(&sstable{path: path}).remove()
+		}
+		if num >= l.nextNum {
+			l.nextNum = num + 1
+		}
+	}
+	return nil
+}
+
+func sortByKey(tables []*sstable) {
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].first < tables[j].first
+	})
+}
+
+func (l *LSM) scheduleMerge() {
+	select {
+	case l.merges <- struct{}{}:
+	default:
+	}
+}
+
+func (l *LSM) mergeLoop() {
+	defer l.done.Done()
+
+	for {
+		select {
+		case <-l.closing:
+			return
+		case <-l.merges:
+			for {
+				merged, err := l.mergeOnce()
+				if err != nil || !merged {
+					break
+				}
+				select {
+				case <-l.closing:
+					return
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (l *LSM) levelLimit(level int) int64 {
+	limit := l.opts.LevelSize
+	for i := 1; i < level; i++ {
+		limit *= 10
+	}
+	return limit
+}
+
+// pickMerge chooses the tables of the next merge, ordered from newest to
+// oldest, and the level the result goes to.
+func (l *LSM) pickMerge() ([]*sstable, int) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.levels[0]) >= l.opts.L0Tables {
+		inputs := make([]*sstable, 0, len(l.levels[0]))
+		first, last := l.levels[0][0].first, l.levels[0][0].last
+		for i := len(l.levels[0]) - 1; i >= 0; i-- {
+			t := l.levels[0][i]
+			inputs = append(inputs, t)
+			if t.first < first {
+				first = t.first
+			}
+			if t.last > last {
+				last = t.last
+			}
+		}
+		return append(inputs, overlapping(l.levels[1], first, last)...), 1
+	}
+
+	for level := 1; level < lsmMaxLevels-1; level++ {
+		var size int64
+		for _, t := range l.levels[level] {
+			size += t.size
+		}
+		if size > l.levelLimit(level) {
+			t := l.levels[level][0]
+			return append([]*sstable{t}, overlapping(l.levels[level+1], t.first, t.last)...), level + 1
+		}
+	}
+	return nil, 0
+}
+
+func overlapping(tables []*sstable, first, last string) []*sstable {
+	var res []*sstable
+	for _, t := range tables {
+		if t.overlaps(first, last) {
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// mergeOnce runs a single merge if some level is over its limit.
+func (l *LSM) mergeOnce() (bool, error) {
+	inputs, level := l.pickMerge()
+	if len(inputs) == 0 {
+		return false, nil
+	}
+
+	l.mu.RLock()
+	bottom := true
+	for deeper := level + 1; deeper < lsmMaxLevels; deeper++ {
+		if len(l.levels[deeper]) > 0 {
+			bottom = false
+		}
+	}
+	l.mu.RUnlock()
+
+	outputs, err := l.merge(inputs, bottom)
+	if err != nil {
+		return false, err
+	}
+
+	merged := make(map[*sstable]bool, len(inputs))
+	for _, t := range inputs {
+		merged[t] = true
+	}
+
+	l.mu.Lock()
+	for i := range l.levels {
+		kept := l.levels[i][:0:0]
+		for _, t := range l.levels[i] {
+			if !merged[t] {
+				kept = append(kept, t)
+			}
+		}
+		l.levels[i] = kept
+	}
+	l.levels[level] = append(l.levels[level], outputs...)
+	sortByKey(l.levels[level])
+	err = l.writeManifest()
+	l.mu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+	for _, t := range inputs {
+		t.remove()
+	}
+	return true, nil
+}
+
+// merge writes the latest record of every key of the inputs into new tables
+// of about TableSize each. Tombstones are dropped when no deeper level can
+// hold an older record of the key.
+func (l *LSM) merge(inputs []*sstable, bottom bool) ([]*sstable, error) {
+	keys := 0
+	heads := make([]*sstHead, 0, len(inputs))
+	defer func() {
+		for _, h := range heads {
+			h.it.Close()
+		}
+	}()
+	for _, t := range inputs {
+		keys += t.index.keys
+
+		it, err := t.iterator()
+		if err != nil {
+			return nil, err
+		}
+		h := &sstHead{it: it}
+		heads = append(heads, h)
+		if err := h.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if limit := int(l.opts.TableSize/minEntrySize) + 1; keys > limit {
+		keys = limit
+	}
+
+	var (
+		outputs []*sstable
+		w       *sstableWriter
+	)
+	finish := func() error {
+		if w == nil {
+			return nil
+		}
+		t, err := w.finish()
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, t)
+		w = nil
+		return nil
+	}
+	fail := func(err error) ([]*sstable, error) {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range outputs {
+			t.remove()
+		}
+		return nil, err
+	}
+
+	for {
+		// Inputs go from newest to oldest, so the first head holding the
+		// smallest key has its latest record.
+		var newest *sstHead
+		for _, h := range heads {
+			if !h.done && (newest == nil || h.ent.key < newest.ent.key) {
+				newest = h
+			}
+		}
+		if newest == nil {
+			break
+		}
+
+		e, deleted := newest.ent, newest.deleted
+		for _, h := range heads {
+			if !h.done && h.ent.key == e.key {
+				if err := h.advance(); err != nil {
+					return fail(err)
+				}
+			}
+		}
+
+		if deleted && bottom {
+			continue
+		}
+
+		if w == nil {
+			l.mu.Lock()
+			num := l.nextNum
+			l.nextNum++
+			l.mu.Unlock()
+
+			var err error
+			if w, err = newSSTableWriter(l.dir, num, keys); err != nil {
+				return fail(err)
+			}
+		}
+		if err := w.add(e, deleted); err != nil {
+			return fail(err)
+		}
+		if w.size >= l.opts.TableSize {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	if err := finish(); err != nil {
+		return fail(err)
+	}
+	return outputs, nil
+}
+
+type sstHead struct {
+	it *sstIterator
+
+	ent     entry
+	deleted bool
+	done    bool
+}
+
+func (h *sstHead) advance() error {
+	e, deleted, ok, err := h.it.Next()
+	if err != nil {
+		return err
+	}
+	h.ent, h.deleted, h.done = e, deleted, !ok
+	return nil
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLSMLevels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsm-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsm, err := NewLSM(dir, LSMOptions{
+		MemtableSize: 1024,
+		TableSize:    2048,
+		L0Tables:     2,
+		LevelSize:    4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 2000; i++ {
+		if err := lsm.Put(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	lsm.mu.RLock()
+	defer lsm.mu.RUnlock()
+
+	if len(lsm.levels[0]) >= 2 {
+		t.Errorf("L0 was not merged: %d tables", len(lsm.levels[0]))
+	}
+	if len(lsm.levels[2]) == 0 {
+		t.Errorf("Expected tables on L2")
+	}
+
+	live := 0
+	for level := 1; level < lsmMaxLevels; level++ {
+		tables := lsm.levels[level]
+		live += len(tables)
+		for i := 1; i < len(tables); i++ {
+			if tables[i-1].last >= tables[i].first {
+				t.Errorf("Overlapping tables on L%d: %s..%s and %s..%s", level,
+					tables[i-1].first, tables[i-1].last, tables[i].first, tables[i].last)
+			}
+		}
+	}
+	live += len(lsm.levels[0])
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+sstSuffix))
+	if len(files) != live {
+		t.Errorf("Merged tables are left on disk: %d files for %d live tables", len(files), live)
+	}
+}
+
+func TestLSMTornWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsm-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsm, err := NewLSM(dir, LSMOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsm.Put("key1", "value1")
+	lsm.Put("key2", "value2")
+	lsm.Close()
+
+	// Simulate a crash in the middle of the last write.
+	wal := filepath.Join(dir, walFileName)
+	stat, err := os.Stat(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(wal, stat.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	lsm, err = NewLSM(dir, LSMOptions{})
+	if err != nil {
+		t.Fatal("Failed to reopen after torn write:", err)
+	}
+	defer lsm.Close()
+
+	if value, err := lsm.Get("key1"); err != nil || value != "value1" {
+		t.Errorf("Value mismatch for key1: got %s (%v)", value, err)
+	}
+	if _, err := lsm.Get("key2"); err != ErrNotFound {
+		t.Errorf("Expected the torn write to be dropped, got %v", err)
+	}
+	if err := lsm.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := lsm.Get("key3"); err != nil || value != "value3" {
+		t.Errorf("Value mismatch for key3: got %s (%v)", value, err)
+	}
+}
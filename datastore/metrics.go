@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histograms.
+var latencyBuckets = []float64{
+	0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1,
+}
+
+// Histogram counts durations in fixed buckets, safe for concurrent use.
+type Histogram struct {
+	counts [12]atomic.Uint64 // one per bucket plus +Inf
+	sum    atomic.Int64
+	count  atomic.Uint64
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && seconds > latencyBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+}
+
+// ObserveSince records the time elapsed since start, meant to be deferred.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start))
+}
+
+type Bucket struct {
+	UpperBound float64 `json:"le"`
+	Count      uint64  `json:"count"`
+}
+
+// HistogramSnapshot holds cumulative bucket counts, the last bucket is +Inf
+// and is left out since it equals Count.
+type HistogramSnapshot struct {
+	Buckets []Bucket `json:"buckets"`
+	Sum     float64  `json:"sum"`
+	Count   uint64   `json:"count"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Buckets: make([]Bucket, len(latencyBuckets)),
+		Sum:     time.Duration(h.sum.Load()).Seconds(),
+		Count:   h.count.Load(),
+	}
+
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i].Load()
+		snapshot.Buckets[i] = Bucket{UpperBound: bound, Count: cumulative}
+	}
+	return snapshot
+}
@@ -0,0 +1,234 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const namespaceConfigFileName = "namespace.json"
+
+var (
+	ErrNamespaceExists   = fmt.Errorf("namespace already exists")
+	ErrNamespaceNotFound = fmt.Errorf("namespace does not exist")
+	ErrNamespaceDropping = fmt.Errorf("namespace is being dropped")
+	ErrInvalidNamespace  = fmt.Errorf("namespace names are 1 to 64 letters, digits, '-' or '_'")
+)
+
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// NamespaceConfig is stored next to the data of a namespace, so it is
+// reopened with the same settings.
+type NamespaceConfig struct {
+	SegmentSize int64     `json:"segment_size"`
+	Index       IndexMode `json:"index,omitempty"`
+	// Engine is HashEngine, the default for namespaces stored without one,
+	// or LSMEngine.
+	Engine string `json:"engine,omitempty"`
+}
+
+type NamespaceInfo struct {
+	Name string `json:"name"`
+	NamespaceConfig
+}
+
+// Namespaces keeps named databases, each a Db of its own in a subdirectory,
+// with its own segments and compaction.
+type Namespaces struct {
+	dir         string
+	segmentSize int64
+	engine      string
+	opts        Options
+
+	mu  sync.RWMutex
+	dbs map[string]*namespace
+}
+
+type namespace struct {
+	db     Engine
+	config NamespaceConfig
+	// users counts the holders of db, which Drop waits for before closing it.
+	users sync.WaitGroup
+	// dropping keeps the name taken until Drop has removed the data.
+	dropping bool
+}
+
+// OpenNamespaces opens every namespace found in the directory. Namespaces
+// created without a segment size or an engine get the given ones; the size
+// limits of opts apply to all of them.
+func OpenNamespaces(dir string, segmentSize int64, engine string, opts Options) (*Namespaces, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	ns := &Namespaces{
+		dir:         dir,
+		segmentSize: segmentSize,
+		engine:      engine,
+		opts:        opts,
+		dbs:         make(map[string]*namespace),
+	}
+
+	configs, err := filepath.Glob(filepath.Join(dir, "*", namespaceConfigFileName))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range configs {
+		name := filepath.Base(filepath.Dir(path))
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			ns.Close()
+			return nil, err
+		}
+		var config NamespaceConfig
+		if err := json.Unmarshal(data, &config); err != nil {
+			ns.Close()
+			return nil, fmt.Errorf("corrupted config of namespace %s: %v", name, err)
+		}
+		if config.Engine == "" {
+			config.Engine = HashEngine
+		}
+
+		db, err := OpenEngine(config.Engine, filepath.Dir(path), config.SegmentSize, ns.options(config))
+		if err != nil {
+			ns.Close()
+			return nil, err
+		}
+		ns.dbs[name] = &namespace{db: db, config: config}
+	}
+
+	return ns, nil
+}
+
+// Create makes a new namespace with an empty database.
+func (ns *Namespaces) Create(name string, config NamespaceConfig) (Engine, error) {
+	if !namespaceName.MatchString(name) {
+		return nil, ErrInvalidNamespace
+	}
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = ns.segmentSize
+	}
+	if config.Engine == "" {
+		config.Engine = ns.engine
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if n, ok := ns.dbs[name]; ok {
+		if n.dropping {
+			return nil, ErrNamespaceDropping
+		}
+		return nil, ErrNamespaceExists
+	}
+
+	dir := filepath.Join(ns.dir, name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	db, err := OpenEngine(config.Engine, dir, config.SegmentSize, ns.options(config))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// The config is written last, a directory without it is not a
+	// namespace yet and gets reused on the next attempt.
+	data, err := json.Marshal(config)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, namespaceConfigFileName), data, 0o600)
+	}
+	if err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	ns.dbs[name] = &namespace{db: db, config: config}
+	return db, nil
+}
+
+func (ns *Namespaces) options(config NamespaceConfig) Options {
+	opts := ns.opts
+	opts.Index = config.Index
+	return opts
+}
+
+// Get returns the database of the namespace and a function to call once it
+// is no longer used, which lets a concurrent Drop close it.
+func (ns *Namespaces) Get(name string) (Engine, func(), error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	n, ok := ns.dbs[name]
+	if !ok || n.dropping {
+		return nil, nil, ErrNamespaceNotFound
+	}
+	n.users.Add(1)
+	return n.db, n.users.Done, nil
+}
+
+// List returns the namespaces sorted by name.
+func (ns *Namespaces) List() []NamespaceInfo {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	list := make([]NamespaceInfo, 0, len(ns.dbs))
+	for name, n := range ns.dbs {
+		if n.dropping {
+			continue
+		}
+		list = append(list, NamespaceInfo{Name: name, NamespaceConfig: n.config})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Drop closes the database of the namespace and removes its data. The
+// namespace is gone for new callers right away, the database is closed once
+// the callers of Get that still hold it are done. The name can not be
+// created again until the data is removed.
+func (ns *Namespaces) Drop(name string) error {
+	ns.mu.Lock()
+	n, ok := ns.dbs[name]
+	if !ok || n.dropping {
+		ns.mu.Unlock()
+		return ErrNamespaceNotFound
+	}
+	n.dropping = true
+	ns.mu.Unlock()
+
+	n.users.Wait()
+	n.db.Close()
+	err := os.RemoveAll(filepath.Join(ns.dir, name))
+
+	ns.mu.Lock()
+	delete(ns.dbs, name)
+	ns.mu.Unlock()
+	return err
+}
+
+func (ns *Namespaces) Close() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	var err error
+	for _, n := range ns.dbs {
+		if n.dropping {
+			// Drop closes it.
+			continue
+		}
+		if closeErr := n.db.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	ns.dbs = make(map[string]*namespace)
+	return err
+}
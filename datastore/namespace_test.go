@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNamespaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ns-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ns, err := OpenNamespaces(dir, 4096, HashEngine, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := ns.Create("users", NamespaceConfig{SegmentSize: 100})
+	if err != nil {
+		t.Fatal("Failed to create namespace:", err)
+	}
+	orders, err := ns.Create("orders", NamespaceConfig{})
+	if err != nil {
+		t.Fatal("Failed to create namespace:", err)
+	}
+
+	if _, err := ns.Create("users", NamespaceConfig{}); err != ErrNamespaceExists {
+		t.Errorf("Expected ErrNamespaceExists, got %v", err)
+	}
+	if _, err := ns.Create("../escape", NamespaceConfig{}); err != ErrInvalidNamespace {
+		t.Errorf("Expected ErrInvalidNamespace, got %v", err)
+	}
+
+	users.Put("key", "user")
+	orders.Put("key", "order")
+
+	t.Run("Keyspaces are separate", func(t *testing.T) {
+		if value, _ := users.Get("key"); value != "user" {
+			t.Errorf("Unexpected value in users: %s", value)
+		}
+		if value, _ := orders.Get("key"); value != "order" {
+			t.Errorf("Unexpected value in orders: %s", value)
+		}
+	})
+
+	t.Run("Namespaces survive reopening", func(t *testing.T) {
+		if err := ns.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ns, err = OpenNamespaces(dir, 4096, HashEngine, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		list := ns.List()
+		if len(list) != 2 || list[0].Name != "orders" || list[1].Name != "users" {
+			t.Fatalf("Unexpected namespaces %v", list)
+		}
+		if list[0].SegmentSize != 4096 || list[1].SegmentSize != 100 {
+			t.Errorf("Segment sizes were not kept: %v", list)
+		}
+
+		db, release, err := ns.Get("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+		if value, _ := db.Get("key"); value != "user" {
+			t.Errorf("Unexpected value in users: %s", value)
+		}
+	})
+
+	t.Run("Drop", func(t *testing.T) {
+		held, release, err := ns.Get("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped := make(chan error)
+		go func() {
+			dropped <- ns.Drop("users")
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+		if value, err := held.Get("key"); err != nil || value != "user" {
+			t.Errorf("Held database was closed under its user: %s (%v)", value, err)
+		}
+		select {
+		case <-dropped:
+			t.Fatal("Drop did not wait for the database to be released")
+		default:
+		}
+		if _, _, err := ns.Get("users"); err != ErrNamespaceNotFound {
+			t.Errorf("Expected ErrNamespaceNotFound while dropping, got %v", err)
+		}
+		if _, err := ns.Create("users", NamespaceConfig{}); err != ErrNamespaceDropping {
+			t.Errorf("Expected ErrNamespaceDropping, got %v", err)
+		}
+
+		release()
+		if err := <-dropped; err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ns.Get("users"); err != ErrNamespaceNotFound {
+			t.Errorf("Expected ErrNamespaceNotFound, got %v", err)
+		}
+		if err := ns.Drop("users"); err != ErrNamespaceNotFound {
+			t.Errorf("Expected ErrNamespaceNotFound, got %v", err)
+		}
+
+		db, err := ns.Create("users", NamespaceConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("key"); err != ErrNotFound {
+			t.Errorf("Dropped data is back: %v", err)
+		}
+	})
+
+	t.Run("Engines", func(t *testing.T) {
+		if _, err := ns.Create("events", NamespaceConfig{Engine: LSMEngine}); err != nil {
+			t.Fatal(err)
+		}
+		if err := ns.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ns, err = OpenNamespaces(dir, 4096, LSMEngine, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db, _, _ := ns.Get("events"); db == nil {
+			t.Fatal("Namespace events was not reopened")
+		} else if _, ok := db.(*LSM); !ok {
+			t.Errorf("Namespace events is not on the LSM engine: %T", db)
+		}
+		if db, _, _ := ns.Get("orders"); db == nil {
+			t.Fatal("Namespace orders was not reopened")
+		} else if _, ok := db.(*Db); !ok {
+			t.Errorf("Namespace orders changed its engine: %T", db)
+		}
+
+		db, err := ns.Create("logs", NamespaceConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := db.(*LSM); !ok {
+			t.Errorf("New namespace does not take the default engine: %T", db)
+		}
+	})
+
+	ns.Close()
+}
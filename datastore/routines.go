@@ -1,76 +1,216 @@
 package datastore
 
 type HashOperation struct {
-	put   bool
-	key   string
-	index int64
+	put     bool
+	key     string
+	updates []IndexUpdate
+	// Each operation gets its own reply channel so concurrent readers
+	// never receive each other's answers.
+	answer chan *SegmentPosition
+
+	// Lookup of several keys at once, answered on positions in the same
+	// order with nil for missing keys.
+	many      []string
+	positions chan []*SegmentPosition
+
+	// Listing of live keys after the given one, answered on keys.
+	after string
+	limit int
+	keys  chan keyList
+}
+
+type keyList struct {
+	keys []string
+	err  error
+}
+
+// IndexUpdate points a key at the record the writer has just appended.
+type IndexUpdate struct {
+	segment  *Segment
+	key      string
+	position int64
+	size     int64
+	version  uint64
+	deleted  bool
 }
 
 type SegmentPosition struct {
 	segment  *Segment
 	position int64
+	version  uint64
+}
+
+// EntryMutation is a single record written by the writer goroutine.
+type EntryMutation struct {
+	ent    entry
+	delete bool
 }
 
 type EntryElement struct {
-	ent entry
-	err chan error
+	muts []EntryMutation
+	// Versions observed by a transaction, validated before writing.
+	reads map[string]uint64
+	// version, if set, receives the version of the last mutation before
+	// the result is sent on err.
+	version *uint64
+	err     chan error
 }
 
 type HashOperator struct {
 	queries chan HashOperation
-	answers chan *SegmentPosition
 }
 
 func (db *Db) handleInput() {
 	go func() {
+		defer db.done.Done()
+		defer close(db.closed)
 		for {
-			ee := <-db.ops
-			stat, err := db.out.Stat()
-			if err != nil {
-				ee.err <- err
-				continue
+			select {
+			case ee := <-db.ops:
+				ee.err <- db.write(ee)
+			case <-db.closing:
+				return
 			}
+		}
+	}()
+}
 
-			if stat.Size()+ee.ent.Length() > db.segments.size {
-				err := db.addSegment()
-				if err != nil {
-					ee.err <- err
-					continue
-				}
-			}
+func (db *Db) write(ee EntryElement) error {
+	for key, version := range ee.reads {
+		var current uint64
+		keyPos, err := db.find(key)
+		if err != nil {
+			return err
+		}
+		if keyPos != nil {
+			current = keyPos.version
+		}
+		if current != version {
+			return ErrConflict
+		}
+	}
 
-			n, err := db.out.Write(ee.ent.Encode())
-			if err == nil {
-				db.operator.queries <- HashOperation{
-					put:   true,
-					key:   ee.ent.key,
-					index: int64(n),
-				}
-			}
-			ee.err <- nil
+	var (
+		data   []byte
+		sizes  []int64
+		length int64
+	)
+	for _, m := range ee.muts {
+		var encoded []byte
+		if m.delete {
+			encoded = m.ent.EncodeTombstone()
+		} else {
+			encoded = m.ent.Encode()
 		}
-	}()
+		data = append(data, encoded...)
+		sizes = append(sizes, int64(len(encoded)))
+		length += m.ent.Length()
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	stat, err := db.out.Stat()
+	if err != nil {
+		return err
+	}
+
+	if stat.Size() > 0 && stat.Size()+length > db.segments.size {
+		err := db.addSegment()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The whole batch goes out in a single write to the active segment.
+	if _, err := db.out.Write(data); err != nil {
+		return err
+	}
+
+	segment := db.segments.GetLast()
+	updates := make([]IndexUpdate, len(ee.muts))
+	for i, m := range ee.muts {
+		db.version++
+		updates[i] = IndexUpdate{
+			segment:  segment,
+			key:      m.ent.key,
+			position: db.offset,
+			size:     sizes[i],
+			version:  db.version,
+			deleted:  m.delete,
+		}
+		db.offset += sizes[i]
+	}
+
+	// Wait until the index points at the new records, so that they are
+	// visible to readers and compaction once the write is acknowledged.
+	op := HashOperation{
+		put:     true,
+		updates: updates,
+		answer:  make(chan *SegmentPosition),
+	}
+	if !db.query(op) {
+		return ErrClosed
+	}
+	<-op.answer
+
+	db.notify(ee.muts, updates)
+	if ee.version != nil {
+		*ee.version = db.version
+	}
+	return nil
 }
 
 func (db *Db) handleOperations() {
 	go func() {
+		defer db.done.Done()
 		for {
-			op := <-db.operator.queries
+			var op HashOperation
+			select {
+			case op = <-db.operator.queries:
+			case <-db.closed:
+				return
+			}
+			if op.keys != nil {
+				op.keys <- db.listKeys(op.after, op.limit)
+				continue
+			}
+			if op.positions != nil {
+				op.positions <- db.findMany(op.many)
+				continue
+			}
 			if op.put {
-				db.segments.GetLast().index[op.key] = db.offset
-				db.offset += op.index
+				for _, u := range op.updates {
+					if u.segment != db.active {
+						db.activate(u.segment)
+					}
+					db.setState(u.key, keyState{
+						version: u.version,
+						size:    u.size,
+						deleted: u.deleted,
+					})
+					u.segment.mu.Lock()
+					if _, ok := u.segment.index[u.key]; !ok {
+						u.segment.sorted = nil
+					}
+					u.segment.index[u.key] = u.position
+					u.segment.bloom.Add(u.key)
+					u.segment.mu.Unlock()
+				}
+				op.answer <- nil
 				continue
 			}
 
 			seg, pos, err := db.segments.Find(op.key)
 			if err != nil {
-				db.operator.answers <- nil
+				op.answer <- nil
 				continue
 			}
 
-			db.operator.answers <- &SegmentPosition{
+			op.answer <- &SegmentPosition{
 				seg,
 				pos,
+				db.versionAt(op.key, seg),
 			}
 		}
 	}()
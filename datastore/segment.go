@@ -5,7 +5,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	compactionDelay  = 100 * time.Millisecond
+	segmentsFileName = "segments"
 )
 
 type Segment struct {
@@ -13,11 +23,120 @@ type Segment struct {
 	offset int64
 
 	index HashIndex
-	mu    sync.Mutex
+	// Sorted keys of index for listings, built on the first one and
+	// dropped when a new key is added.
+	sorted []string
+	sparse *SparseIndex
+	bloom  *BloomFilter
+	// Set once the filter on disk matches bloom.
+	bloomSaved bool
+	mu         sync.Mutex
+
+	// Version of the newest record of a sealed segment. In sparse mode it
+	// stands for the versions of all its keys, which are not kept in memory.
+	version uint64
 }
 
-func (s *Segment) Read(pos int64) (string, error) {
+// loadSparse picks up the index spilled when the segment was sealed. Lookups
+// check the filter first, so the saved filter is needed as well.
+func (s *Segment) loadSparse(interval int) bool {
+	if !s.bloomSaved {
+		return false
+	}
+	sparse, err := loadSparseIndex(s.path+indexSuffix, interval)
+	if err != nil {
+		return false
+	}
+
+	s.sparse = sparse
+	s.index = nil
+	return true
+}
+
+// seal persists the filter of a segment that no longer receives writes.
+// With a positive interval its index is spilled to disk as well.
+func (s *Segment) seal(interval int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.bloomSaved {
+		if err := writeBloom(s.path, s.bloom); err != nil {
+			return err
+		}
+		s.bloomSaved = true
+	}
+	if interval <= 0 || s.sparse != nil {
+		return nil
+	}
+
+	sparse, err := writeSparseIndex(s.path, s.index, interval)
+	if err != nil {
+		return err
+	}
+	s.sparse = sparse
+	s.index = nil
+	s.sorted = nil
+	return nil
+}
+
+// lookup finds the key in the in-memory or the spilled index. The caller
+// holds s.mu.
+func (s *Segment) lookup(key string) (int64, bool, error) {
+	if s.sparse != nil {
+		return s.sparse.Find(key)
+	}
+	pos, ok := s.index[key]
+	return pos, ok, nil
+}
+
+func (s *Segment) keyCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sparse != nil {
+		return s.sparse.keys
+	}
+	return len(s.index)
+}
+
+func (s *Segment) iteratorAfter(after string) (indexIterator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sparse != nil {
+		return s.sparse.IteratorAfter(after)
+	}
+	if s.sorted == nil {
+		s.sorted = sortedKeys(s.index)
+	}
+	return newHashIterator(s.index, s.sorted, after), nil
+}
+
+// state reads the header of the record at pos.
+func (s *Segment) state(pos int64) (keyState, error) {
 	file, err := os.Open(s.path)
+	if err != nil {
+		return keyState{}, err
+	}
+	defer file.Close()
+
+	size, deleted, err := readHeaderAt(file, pos)
+	if err != nil {
+		return keyState{}, err
+	}
+	return keyState{
+		version: s.version,
+		size:    size,
+		deleted: deleted,
+	}, nil
+}
+
+func (s *Segment) Read(pos int64) (string, error) {
+	return readValueAt(s.path, pos)
+}
+
+func readValueAt(path string, pos int64) (string, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
@@ -42,6 +161,23 @@ type SegmentList struct {
 	list   []*Segment
 	length int
 	size   int64
+	// Index interval of spilled closed segments, 0 keeps them in memory.
+	spill int
+
+	mu         sync.RWMutex
+	compacting sync.Mutex
+	// The timer of a scheduled compaction, guarded by mu, and whether Close
+	// has stopped compactions.
+	compaction *time.Timer
+	closed     atomic.Bool
+
+	// Lookups the bloom filters answered without touching the index, and
+	// lookups they let through for keys the segment does not hold.
+	bloomNegatives      atomic.Uint64
+	bloomFalsePositives atomic.Uint64
+
+	compactions    atomic.Uint64
+	lastCompaction atomic.Int64
 }
 
 func NewSegmentList(size int64, outDir string) *SegmentList {
@@ -63,6 +199,16 @@ func (sl *SegmentList) getPath() string {
 }
 
 func (sl *SegmentList) Add() (*os.File, error) {
+	sl.mu.RLock()
+	count := len(sl.list)
+	sl.mu.RUnlock()
+
+	if count > 0 {
+		if err := sl.GetLast().seal(sl.spill); err != nil {
+			return nil, err
+		}
+	}
+
 	path := sl.getPath()
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
 	if err != nil {
@@ -72,11 +218,21 @@ func (sl *SegmentList) Add() (*os.File, error) {
 	segment := &Segment{
 		path:  path,
 		index: make(HashIndex),
+		bloom: NewBloomFilter(int(sl.size/minEntrySize) + 1),
 	}
 
+	sl.mu.Lock()
 	sl.list = append(sl.list, segment)
+	count = len(sl.list)
+	err = sl.writeManifest()
+	sl.mu.Unlock()
 
-	if len(sl.list) >= 3 {
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if count >= 3 {
 		sl.length++
 		sl.Compact()
 	}
@@ -85,83 +241,368 @@ func (sl *SegmentList) Add() (*os.File, error) {
 	return f, nil
 }
 
+// The manifest lists the live segment files from oldest to newest. It is
+// replaced atomically whenever the list changes; files that are not listed
+// were merged by compaction and are removed on the next start.
+func (sl *SegmentList) writeManifest() error {
+	var b strings.Builder
+	for _, s := range sl.list {
+		b.WriteString(filepath.Base(s.path))
+		b.WriteByte('\n')
+	}
+
+	path := filepath.Join(sl.outDir, segmentsFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Restore puts the live segments of the directory into the list, ordered
+// from oldest to newest, with empty indexes for the caller to fill.
+// Directories written before the manifest existed only hold numbered
+// segments, which are taken in numeric order.
+func (sl *SegmentList) Restore() ([]*Segment, error) {
+	files, err := filepath.Glob(filepath.Join(sl.outDir, outFileName+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	numbered := make(map[string]int)
+	for _, path := range files {
+		name := filepath.Base(path)
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, outFileName)); err == nil {
+			numbered[name] = n
+			if n >= sl.length {
+				sl.length = n + 1
+			}
+		}
+	}
+
+	var names []string
+	data, err := os.ReadFile(filepath.Join(sl.outDir, segmentsFileName))
+	switch {
+	case err == nil:
+		names = strings.Fields(string(data))
+	case os.IsNotExist(err):
+		for name := range numbered {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return numbered[names[i]] < numbered[names[j]]
+		})
+	default:
+		return nil, err
+	}
+
+	live := make(map[string]bool, len(names))
+	for _, name := range names {
+		live[name] = true
+	}
+	for _, path := range files {
+		name := filepath.Base(path)
+		segment := strings.SplitN(name, ".", 2)[0]
+		if !live[segment] {
+			os.Remove(path)
+		}
+	}
+
+	for i, name := range names {
+		path := filepath.Join(sl.outDir, name)
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		segment := &Segment{
+			path:  path,
+			index: make(HashIndex),
+		}
+		// Closed segments keep the filter saved when they were sealed. The
+		// newest one still takes writes, and a missing or unreadable file
+		// leaves an empty filter for the replay to fill.
+		if i < len(names)-1 {
+			if bf, err := readBloom(path); err == nil {
+				segment.bloom = bf
+				segment.bloomSaved = true
+			}
+		}
+		if segment.bloom == nil {
+			segment.bloom = NewBloomFilter(int(stat.Size()/minEntrySize) + 1)
+		}
+		sl.list = append(sl.list, segment)
+	}
+
+	if err := sl.writeManifest(); err != nil {
+		return nil, err
+	}
+	return sl.snapshot(), nil
+}
+
 func (sl *SegmentList) GetLast() *Segment {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
 	return sl.list[len(sl.list)-1]
 }
 
+// snapshot returns a copy of the current segment list that stays valid while
+// compaction replaces segments.
+func (sl *SegmentList) snapshot() []*Segment {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	list := make([]*Segment, len(sl.list))
+	copy(list, sl.list)
+	return list
+}
+
+// Find looks the key up starting from the newest segment, so the most
+// recent record of the key wins. Segments whose bloom filter rules the key
+// out are skipped.
 func (sl *SegmentList) Find(key string) (*Segment, int64, error) {
-	for _, segment := range sl.list {
-		pos, ok := segment.index[key]
+	return sl.findIn(sl.snapshot(), key)
+}
+
+// findIn looks the key up in a snapshot of the list, so that several lookups
+// can see the same segments.
+func (sl *SegmentList) findIn(list []*Segment, key string) (*Segment, int64, error) {
+	for i := len(list) - 1; i >= 0; i-- {
+		segment := list[i]
 		segment.mu.Lock()
+		if !segment.bloom.MayContain(key) {
+			segment.mu.Unlock()
+			sl.bloomNegatives.Add(1)
+			continue
+		}
+		pos, ok, err := segment.lookup(key)
+		segment.mu.Unlock()
 
+		if err != nil {
+			return nil, 0, err
+		}
 		if ok {
-			segment.mu.Unlock()
 			return segment, pos, nil
 		}
-
-		segment.mu.Unlock()
+		sl.bloomFalsePositives.Add(1)
 	}
 
 	return nil, 0, ErrNotFound
 }
 
-func contains(list []*Segment, key string) bool {
-	for _, s := range list {
-		s.mu.Lock()
+// Compact merges every segment except the active one into a single segment.
+// The merge starts after compactionDelay so that a burst of rollovers is
+// compacted once. Only one compaction runs at a time; a skipped one is retried
+// on the next Add since the segment count stays above the threshold.
+func (sl *SegmentList) Compact() {
+	if !sl.compacting.TryLock() {
+		return
+	}
+	if sl.closed.Load() {
+		sl.compacting.Unlock()
+		return
+	}
+	path := sl.getPath()
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.compaction = time.AfterFunc(compactionDelay, func() {
+		defer sl.compacting.Unlock()
+		if sl.closed.Load() {
+			return
+		}
 
-		_, ok := s.index[key]
+		start := time.Now()
+		list := sl.snapshot()
+		last := len(list) - 1
 
-		if ok {
-			s.mu.Unlock()
-			return true
+		segment, err := sl.merge(path, list[:last])
+		if err != nil {
+			// The merged segments stay live, only the partial result goes.
+			os.Remove(path)
+			os.Remove(path + indexSuffix)
+			os.Remove(path + indexSuffix + ".tmp")
+			os.Remove(path + bloomSuffix)
+			return
 		}
-		s.mu.Unlock()
+
+		sl.mu.Lock()
+		sl.list = append([]*Segment{segment}, sl.list[last:]...)
+		// If this fails the merged segments stay listed, and they are
+		// still on disk, so a restart simply drops the merge result.
+		_ = sl.writeManifest()
+		sl.mu.Unlock()
+
+		sl.compactions.Add(1)
+		sl.lastCompaction.Store(int64(time.Since(start)))
+	})
+}
+
+// Close cancels a scheduled compaction and waits for a running one, so
+// nothing is written to the directory afterwards.
+func (sl *SegmentList) Close() {
+	sl.closed.Store(true)
+
+	sl.mu.Lock()
+	stopped := sl.compaction != nil && sl.compaction.Stop()
+	sl.mu.Unlock()
+	if stopped {
+		// The compaction never started and left compacting locked.
+		sl.compacting.Unlock()
+		return
 	}
-	return false
+
+	sl.compacting.Lock()
+	sl.compacting.Unlock()
 }
 
-func (sl *SegmentList) Compact() {
-	go func() {
-		path := sl.getPath()
+// merge writes the latest live record of every key of the closed segments,
+// ordered from oldest to newest, into a new segment. A record that cannot be
+// read aborts the merge rather than losing the key.
+func (sl *SegmentList) merge(path string, list []*Segment) (*Segment, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-		segment := &Segment{
-			path:  path,
-			index: make(HashIndex),
+	keys := 0
+	for _, s := range list {
+		keys += s.keyCount()
+	}
+
+	segment := &Segment{
+		path:  path,
+		bloom: NewBloomFilter(keys),
+	}
+	if len(list) > 0 {
+		segment.version = list[len(list)-1].version
+	}
+	var index *sparseIndexWriter
+	if sl.spill > 0 {
+		if index, err = newSparseIndexWriter(path, sl.spill); err != nil {
+			return nil, err
 		}
+		defer index.f.Close()
+	} else {
+		segment.index = make(HashIndex)
+	}
 
-		var offset int64
-		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	var offset int64
+	err = walk(list, "", func(key string, s *Segment, pos int64) (bool, error) {
+		value, err := s.Read(pos)
+		if err == ErrNotFound {
+			// Deleted keys are dropped.
+			return true, nil
+		}
 		if err != nil {
-			return
+			return false, fmt.Errorf("compacting %s: %w", s.path, err)
+		}
+		e := entry{
+			key:   key,
+			value: value,
 		}
 
-		last := len(sl.list) - 1
-		for i := 0; i < last; i++ {
-			s := sl.list[i]
-			s.mu.Lock()
+		n, err := f.Write(e.Encode())
+		if err != nil {
+			return false, err
+		}
+		if index != nil {
+			if err := index.Add(key, offset); err != nil {
+				return false, err
+			}
+		} else {
+			segment.index[key] = offset
+			segment.sorted = append(segment.sorted, key)
+		}
+		segment.bloom.Add(key)
+		offset += int64(n)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-			for key, index := range s.index {
-				if i < last-1 {
-					isNew := contains(sl.list[i+1:last], key)
-					if isNew {
-						continue
-					}
-				}
+	if index != nil {
+		if segment.sparse, err = index.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := segment.seal(sl.spill); err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
 
-				value, _ := s.Read(index)
-				e := entry{
-					key:   key,
-					value: value,
-				}
+// walk visits the keys greater than after of the segments, ordered from
+// oldest to newest, in sorted order. Each key comes with the newest segment
+// holding it and the position of its latest record there. Keys are visited
+// across all segments at once, so spilled indexes are never loaded into
+// memory. The walk stops when fn returns false or an error.
+func walk(list []*Segment, after string, fn func(key string, s *Segment, pos int64) (bool, error)) error {
+	heads := make([]*mergeHead, 0, len(list))
+	defer func() {
+		for _, h := range heads {
+			h.it.Close()
+		}
+	}()
+	for _, s := range list {
+		it, err := s.iteratorAfter(after)
+		if err != nil {
+			return err
+		}
+		h := &mergeHead{segment: s, it: it}
+		heads = append(heads, h)
+		if err := h.advance(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		// The newest segment holding the smallest key has its latest record.
+		var newest *mergeHead
+		for _, h := range heads {
+			if h.done {
+				continue
+			}
+			if newest == nil || h.key <= newest.key {
+				newest = h
+			}
+		}
+		if newest == nil {
+			return nil
+		}
 
-				n, err := f.Write(e.Encode())
-				if err == nil {
-					segment.index[key] = offset
-					offset += int64(n)
+		key, s, pos := newest.key, newest.segment, newest.pos
+		for _, h := range heads {
+			if !h.done && h.key == key {
+				if err := h.advance(); err != nil {
+					return err
 				}
 			}
-			s.mu.Unlock()
 		}
-		sl.list = []*Segment{segment, sl.GetLast()}
-	}()
+
+		if more, err := fn(key, s, pos); err != nil || !more {
+			return err
+		}
+	}
+}
+
+type mergeHead struct {
+	segment *Segment
+	it      indexIterator
+
+	key  string
+	pos  int64
+	done bool
+}
+
+func (h *mergeHead) advance() error {
+	key, pos, ok, err := h.it.Next()
+	if err != nil {
+		return err
+	}
+	h.key, h.pos, h.done = key, pos, !ok
+	return nil
 }
@@ -0,0 +1,215 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	sstSuffix        = ".sst"
+	sstIndexInterval = 16
+)
+
+// sstable is an immutable file of records sorted by key. Records use the
+// segment encoding, the key index and the bloom filter live next to it.
+type sstable struct {
+	num   uint64
+	path  string
+	size  int64
+	first string
+	last  string
+
+	index *SparseIndex
+	bloom *BloomFilter
+}
+
+func sstPath(dir string, num uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", num, sstSuffix))
+}
+
+func openSSTable(dir string, num uint64) (*sstable, error) {
+	path := sstPath(dir, num)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadSparseIndex(path+indexSuffix, sstIndexInterval)
+	if err != nil {
+		return nil, err
+	}
+	bloom, err := readBloom(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &sstable{
+		num:   num,
+		path:  path,
+		size:  stat.Size(),
+		last:  index.last,
+		index: index,
+		bloom: bloom,
+	}
+	if len(index.samples) > 0 {
+		t.first = index.samples[0].key
+	}
+	return t, nil
+}
+
+// get reports whether the table holds a record of the key. A tombstone is
+// found with ErrNotFound.
+func (t *sstable) get(key string) (string, bool, error) {
+	if key < t.first || key > t.last || !t.bloom.MayContain(key) {
+		return "", false, nil
+	}
+
+	pos, ok, err := t.index.Find(key)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	value, err := readValueAt(t.path, pos)
+	return value, true, err
+}
+
+func (t *sstable) overlaps(first, last string) bool {
+	return t.first <= last && t.last >= first
+}
+
+func (t *sstable) remove() {
+	os.Remove(t.path)
+	os.Remove(t.path + indexSuffix)
+	os.Remove(t.path + bloomSuffix)
+}
+
+type sstableWriter struct {
+	num   uint64
+	path  string
+	f     *os.File
+	out   *bufio.Writer
+	index *sparseIndexWriter
+	bloom *BloomFilter
+	size  int64
+	first string
+}
+
+func newSSTableWriter(dir string, num uint64, keys int) (*sstableWriter, error) {
+	path := sstPath(dir, num)
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := newSparseIndexWriter(path, sstIndexInterval)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &sstableWriter{
+		num:   num,
+		path:  path,
+		f:     f,
+		out:   bufio.NewWriter(f),
+		index: index,
+		bloom: NewBloomFilter(keys),
+	}, nil
+}
+
+// add appends a record; keys must come in increasing order.
+func (w *sstableWriter) add(e entry, deleted bool) error {
+	var data []byte
+	if deleted {
+		data = e.EncodeTombstone()
+	} else {
+		data = e.Encode()
+	}
+
+	if _, err := w.out.Write(data); err != nil {
+		return err
+	}
+	if err := w.index.Add(e.key, w.size); err != nil {
+		return err
+	}
+	if w.size == 0 {
+		w.first = e.key
+	}
+	w.bloom.Add(e.key)
+	w.size += int64(len(data))
+	return nil
+}
+
+func (w *sstableWriter) finish() (*sstable, error) {
+	if err := w.out.Flush(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := w.f.Close(); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	index, err := w.index.Close()
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+	if err := writeBloom(w.path, w.bloom); err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	return &sstable{
+		num:   w.num,
+		path:  w.path,
+		size:  w.size,
+		first: w.first,
+		last:  index.last,
+		index: index,
+		bloom: w.bloom,
+	}, nil
+}
+
+// abort drops a table that could not be completed.
+func (w *sstableWriter) abort() {
+	w.f.Close()
+	w.index.abort()
+	(&sstable{path: w.path}).remove()
+}
+
+// sstIterator reads the records of a table in key order.
+type sstIterator struct {
+	f  *os.File
+	in *bufio.Reader
+}
+
+func (t *sstable) iterator() (*sstIterator, error) {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	return &sstIterator{f: f, in: bufio.NewReader(f)}, nil
+}
+
+func (it *sstIterator) Next() (entry, bool, bool, error) {
+	e, deleted, err := readRecord(it.in)
+	if err == io.EOF {
+		return e, false, false, nil
+	}
+	if err != nil {
+		return e, false, false, err
+	}
+	return e, deleted, true, nil
+}
+
+func (it *sstIterator) Close() error {
+	return it.f.Close()
+}
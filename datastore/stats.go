@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Stats is a point-in-time view of the database internals.
+type Stats struct {
+	Keys     int64          `json:"keys"`
+	Segments []SegmentStats `json:"segments"`
+	// Bytes taken by the latest records of live keys, and by everything else
+	// in the segments: overwritten values and deletions.
+	LiveBytes int64 `json:"live_bytes"`
+	DeadBytes int64 `json:"dead_bytes"`
+
+	Compactions    uint64        `json:"compactions"`
+	LastCompaction time.Duration `json:"last_compaction_ns"`
+
+	Reads  HistogramSnapshot `json:"reads"`
+	Writes HistogramSnapshot `json:"writes"`
+	// Writes waiting in the queue and writes rejected because it was full.
+	QueuedWrites   int    `json:"queued_writes"`
+	RejectedWrites uint64 `json:"rejected_writes"`
+
+	// Lookups answered by a segment's bloom filter without reading its index.
+	BloomNegatives uint64 `json:"bloom_negatives"`
+	// Lookups the bloom filters let through for keys a segment does not hold.
+	BloomFalsePositives uint64 `json:"bloom_false_positives"`
+	// Share of lookups of absent keys that the filters failed to rule out.
+	BloomFalsePositiveRate float64 `json:"bloom_false_positive_rate"`
+}
+
+type SegmentStats struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func (db *Db) Stats() Stats {
+	negatives := db.segments.bloomNegatives.Load()
+	falsePositives := db.segments.bloomFalsePositives.Load()
+
+	stats := Stats{
+		Keys:      db.liveKeys.Load(),
+		LiveBytes: db.liveBytes.Load(),
+
+		Compactions:    db.segments.compactions.Load(),
+		LastCompaction: time.Duration(db.segments.lastCompaction.Load()),
+
+		Reads:  db.reads.Snapshot(),
+		Writes: db.writes.Snapshot(),
+
+		QueuedWrites:   len(db.ops),
+		RejectedWrites: db.rejected.Load(),
+
+		BloomNegatives:      negatives,
+		BloomFalsePositives: falsePositives,
+	}
+	if total := negatives + falsePositives; total > 0 {
+		stats.BloomFalsePositiveRate = float64(falsePositives) / float64(total)
+	}
+
+	var total int64
+	for _, s := range db.segments.snapshot() {
+		var size int64
+		if stat, err := os.Stat(s.path); err == nil {
+			size = stat.Size()
+		}
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Name: filepath.Base(s.path),
+			Size: size,
+		})
+		total += size
+	}
+	if total > stats.LiveBytes {
+		stats.DeadBytes = total - stats.LiveBytes
+	}
+
+	return stats
+}
@@ -0,0 +1,64 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDatabaseStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Put("key1", "value1")
+	db.Put("key2", "value2")
+	db.Put("key1", "value3")
+	db.Put("key3", "value4")
+	db.Delete("key3")
+	db.Get("key1")
+	db.Get("missing")
+
+	stats := db.Stats()
+	if stats.Keys != 2 {
+		t.Errorf("Expected 2 keys, got %d", stats.Keys)
+	}
+	if stats.LiveBytes != 84 {
+		t.Errorf("Expected 84 live bytes, got %d", stats.LiveBytes)
+	}
+	// Two overwritten or deleted records and a tombstone.
+	if stats.DeadBytes != 42+42+36 {
+		t.Errorf("Expected 120 dead bytes, got %d", stats.DeadBytes)
+	}
+	if stats.Writes.Count != 5 || stats.Reads.Count != 2 {
+		t.Errorf("Unexpected operation counts: %d writes, %d reads", stats.Writes.Count, stats.Reads.Count)
+	}
+	if last := stats.Reads.Buckets[len(stats.Reads.Buckets)-1]; last.Count > stats.Reads.Count {
+		t.Errorf("Cumulative bucket exceeds the total: %+v", stats.Reads)
+	}
+
+	t.Run("Compaction", func(t *testing.T) {
+		db.Put("key4", "value5")
+		time.Sleep(500 * time.Millisecond)
+
+		stats := db.Stats()
+		if stats.Compactions != 1 || stats.LastCompaction <= 0 {
+			t.Errorf("Expected a timed compaction, got %d in %s", stats.Compactions, stats.LastCompaction)
+		}
+		if len(stats.Segments) != 2 {
+			t.Errorf("Expected 2 segments, got %+v", stats.Segments)
+		}
+		if stats.Keys != 3 {
+			t.Errorf("Expected 3 keys, got %d", stats.Keys)
+		}
+	})
+}
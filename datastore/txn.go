@@ -0,0 +1,108 @@
+package datastore
+
+// Txn is an optimistic read-modify-write transaction over several keys.
+// Reads record the version they observed, writes are buffered, and Commit
+// applies all writes at once only if none of the read keys has changed since.
+// A Txn is not safe for concurrent use.
+type Txn struct {
+	db *Db
+
+	reads  map[string]uint64
+	writes []EntryMutation
+	staged map[string]int
+
+	done bool
+}
+
+func (db *Db) Begin() *Txn {
+	return &Txn{
+		db:     db,
+		reads:  make(map[string]uint64),
+		staged: make(map[string]int),
+	}
+}
+
+// Get returns the value as seen by the transaction: its own buffered write
+// if there is one, otherwise the stored value. Reading a key that changed
+// since it was first read by this transaction fails with ErrConflict.
+func (t *Txn) Get(key string) (string, error) {
+	if t.done {
+		return "", ErrTxnDone
+	}
+
+	if i, ok := t.staged[key]; ok {
+		m := t.writes[i]
+		if m.delete {
+			return "", ErrNotFound
+		}
+		return m.ent.value, nil
+	}
+
+	value, version, err := t.db.GetVersioned(key)
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+
+	if seen, ok := t.reads[key]; ok && seen != version {
+		return "", ErrConflict
+	}
+	t.reads[key] = version
+
+	return value, err
+}
+
+// Require makes Commit fail unless the key is still at the given version.
+// Version 0 requires that the key has never been written.
+func (t *Txn) Require(key string, version uint64) {
+	t.reads[key] = version
+}
+
+func (t *Txn) Put(key, value string) error {
+	return t.stage(EntryMutation{
+		ent: entry{key: key, value: value},
+	})
+}
+
+func (t *Txn) Delete(key string) error {
+	return t.stage(EntryMutation{
+		ent:    entry{key: key},
+		delete: true,
+	})
+}
+
+func (t *Txn) stage(m EntryMutation) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	if err := t.db.validate(m); err != nil {
+		return err
+	}
+
+	if i, ok := t.staged[m.ent.key]; ok {
+		t.writes[i] = m
+		return nil
+	}
+
+	t.staged[m.ent.key] = len(t.writes)
+	t.writes = append(t.writes, m)
+	return nil
+}
+
+// Commit validates the read versions on the writer goroutine and writes all
+// buffered changes atomically. It returns ErrConflict if any read key changed.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+
+	return t.db.apply(EntryElement{
+		muts:  t.writes,
+		reads: t.reads,
+	})
+}
+
+// Discard abandons the transaction without writing anything.
+func (t *Txn) Discard() {
+	t.done = true
+}
@@ -0,0 +1,148 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "db-testing")
+	if err != nil {
+		t.Fatal("Failed to create temporary directory:", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := NewDb(tempDir, 250)
+	if err != nil {
+		t.Fatal("Failed to create new database:", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("from", "10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("to", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Commit writes all keys", func(t *testing.T) {
+		txn := db.Begin()
+		if _, err := txn.Get("from"); err != nil {
+			t.Fatal("Get in transaction failed:", err)
+		}
+		txn.Put("from", "5")
+		txn.Put("to", "5")
+		txn.Delete("tmp")
+
+		if v, _ := txn.Get("from"); v != "5" {
+			t.Errorf("Transaction does not see its own write: got %s", v)
+		}
+		if v, _ := db.Get("from"); v != "10" {
+			t.Errorf("Uncommitted write is visible: got %s", v)
+		}
+
+		if err := txn.Commit(); err != nil {
+			t.Fatal("Commit failed:", err)
+		}
+		for key, expected := range map[string]string{"from": "5", "to": "5"} {
+			if v, err := db.Get(key); err != nil || v != expected {
+				t.Errorf("Value mismatch for key %s: expected %s, got %s (%v)", key, expected, v, err)
+			}
+		}
+	})
+
+	t.Run("Conflicting commit is rejected", func(t *testing.T) {
+		txn := db.Begin()
+		if _, err := txn.Get("from"); err != nil {
+			t.Fatal(err)
+		}
+		txn.Put("to", "10")
+
+		if err := db.Put("from", "7"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := txn.Commit(); err != ErrConflict {
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+		if v, _ := db.Get("to"); v != "5" {
+			t.Errorf("Rejected transaction wrote a value: got %s", v)
+		}
+		if err := txn.Commit(); err != ErrTxnDone {
+			t.Errorf("Expected ErrTxnDone, got %v", err)
+		}
+	})
+
+	t.Run("Missing keys are versioned", func(t *testing.T) {
+		txn := db.Begin()
+		if _, err := txn.Get("new"); err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound, got %v", err)
+		}
+		txn.Put("new", "value")
+
+		other := db.Begin()
+		other.Require("new", 0)
+		other.Put("new", "other")
+		if err := other.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := txn.Commit(); err != ErrConflict {
+			t.Errorf("Expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		txn := db.Begin()
+		txn.Delete("new")
+		if err := txn.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("new"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if _, version, _ := db.GetVersioned("new"); version == 0 {
+			t.Errorf("Deleted key lost its version")
+		}
+	})
+
+	t.Run("Writes report their version", func(t *testing.T) {
+		version, err := db.PutVersioned("from", "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, stored, _ := db.GetVersioned("from"); stored != version {
+			t.Errorf("Expected version %d, got %d", version, stored)
+		}
+
+		txn := db.Begin()
+		txn.Require("from", version)
+		txn.Put("from", "4")
+		if err := txn.Commit(); err != nil {
+			t.Errorf("Commit at the reported version failed: %v", err)
+		}
+	})
+
+	t.Run("Versions are not reused after a restart", func(t *testing.T) {
+		_, before, err := db.GetVersioned("from")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(tempDir, 250)
+		if err != nil {
+			t.Fatal("Failed to reopen database:", err)
+		}
+
+		txn := db.Begin()
+		txn.Require("from", before)
+		txn.Put("from", "0")
+		if err := txn.Commit(); err != ErrConflict {
+			t.Errorf("Expected ErrConflict for a version of the previous run, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"strings"
+	"sync"
+)
+
+// watchBuffer is how many events a watcher may lag behind before it is
+// dropped.
+const watchBuffer = 256
+
+// Event describes a write seen by a watcher.
+type Event struct {
+	Key     string
+	Value   string
+	Version uint64
+	Deleted bool
+}
+
+type watcher struct {
+	prefix string
+	events chan Event
+}
+
+type watcherSet struct {
+	mu  sync.Mutex
+	set map[*watcher]struct{}
+}
+
+// Watch returns a channel receiving every write of a key with the prefix,
+// in the order of the writes, and a function that stops watching. A watcher
+// that does not keep up gets its channel closed instead of slowing writes
+// down, as does every watcher when the database is closed.
+func (db *Db) Watch(prefix string) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		events: make(chan Event, watchBuffer),
+	}
+
+	db.watchers.mu.Lock()
+	if db.watchers.set == nil {
+		db.watchers.set = make(map[*watcher]struct{})
+	}
+	db.watchers.set[w] = struct{}{}
+	db.watchers.mu.Unlock()
+
+	return w.events, func() {
+		db.watchers.remove(w)
+	}
+}
+
+// notify passes the writes of a batch to the watchers once they are
+// visible to readers.
+func (db *Db) notify(muts []EntryMutation, updates []IndexUpdate) {
+	db.watchers.mu.Lock()
+	defer db.watchers.mu.Unlock()
+
+	for w := range db.watchers.set {
+	events:
+		for i, m := range muts {
+			if !strings.HasPrefix(m.ent.key, w.prefix) {
+				continue
+			}
+
+			event := Event{
+				Key:     m.ent.key,
+				Version: updates[i].version,
+				Deleted: m.delete,
+			}
+			if !m.delete {
+				event.Value = m.ent.value
+			}
+
+			select {
+			case w.events <- event:
+			default:
+				delete(db.watchers.set, w)
+				close(w.events)
+				break events
+			}
+		}
+	}
+}
+
+func (ws *watcherSet) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if _, ok := ws.set[w]; ok {
+		delete(ws.set, w)
+		close(w.events)
+	}
+}
+
+func (ws *watcherSet) closeAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	for w := range ws.set {
+		delete(ws.set, w)
+		close(w.events)
+	}
+}
@@ -0,0 +1,137 @@
+// Package dbapi holds what the HTTP API of cmd/db and its clients share: the
+// error envelope and the helpers to write and decode it.
+package dbapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type ErrorCode string
+
+const (
+	CodeNotFound         ErrorCode = "not_found"
+	CodeCorrupted        ErrorCode = "corrupted"
+	CodeTooLarge         ErrorCode = "too_large"
+	CodeConflict         ErrorCode = "conflict"
+	CodeInvalidKey       ErrorCode = "invalid_key"
+	CodeBadRequest       ErrorCode = "bad_request"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeNotImplemented   ErrorCode = "not_implemented"
+	CodeRateLimited      ErrorCode = "rate_limited"
+	CodeOverloaded       ErrorCode = "overloaded"
+	CodeInternal         ErrorCode = "internal"
+)
+
+// Error is the body of every failed request, wrapped in an envelope:
+// {"error": {"code": "not_found", "message": "..."}}.
+type Error struct {
+	Status  int       `json:"-"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Sentinels to match decoded errors against with errors.Is, which compares
+// codes only.
+var (
+	ErrNotFound  = &Error{Code: CodeNotFound}
+	ErrCorrupted = &Error{Code: CodeCorrupted}
+	ErrTooLarge  = &Error{Code: CodeTooLarge}
+	ErrConflict  = &Error{Code: CodeConflict}
+	// Both come with a Retry-After header and are safe to retry.
+	ErrRateLimited = &Error{Code: CodeRateLimited}
+	ErrOverloaded  = &Error{Code: CodeOverloaded}
+)
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	var t *Error
+	return errors.As(target, &t) && t.Code == e.Code
+}
+
+type ErrorEnvelope struct {
+	Error *Error `json:"error"`
+}
+
+func WriteError(rw http.ResponseWriter, status int, code ErrorCode, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Del("Content-Length")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(ErrorEnvelope{
+		Error: &Error{Code: code, Message: message},
+	})
+}
+
+// MethodNotAllowed answers 405 with the Allow header listing the methods
+// the resource supports.
+func MethodNotAllowed(rw http.ResponseWriter, req *http.Request, allowed ...string) {
+	rw.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteError(rw, http.StatusMethodNotAllowed, CodeMethodNotAllowed,
+		fmt.Sprintf("Method %s is not allowed, use %s", req.Method, strings.Join(allowed, " or ")))
+}
+
+// DecodeError turns a failed response into an *Error. Bodies that are not
+// an envelope, such as those of proxies in between, get a code derived from
+// the status and the body text as the message. The body is consumed.
+func DecodeError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	var envelope ErrorEnvelope
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.Error != nil && envelope.Error.Code != "" {
+		envelope.Error.Status = resp.StatusCode
+		return envelope.Error
+	}
+
+	return &Error{
+		Status:  resp.StatusCode,
+		Code:    codeOf(resp.StatusCode),
+		Message: strings.TrimSpace(string(data)),
+	}
+}
+
+func codeOf(status int) ErrorCode {
+	switch status {
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusRequestEntityTooLarge:
+		return CodeTooLarge
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotImplemented:
+		return CodeNotImplemented
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	}
+	if status >= 400 && status < 500 {
+		return CodeBadRequest
+	}
+	return CodeInternal
+}
+
+// CodeOf returns the code of an *Error in the chain of err, or "" if there
+// is none.
+func CodeOf(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
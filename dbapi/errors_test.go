@@ -0,0 +1,56 @@
+package dbapi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeError(t *testing.T) {
+	rw := httptest.NewRecorder()
+	WriteError(rw, http.StatusNotFound, CodeNotFound, "Key k not found")
+
+	err := DecodeError(rw.Result())
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected *Error, got %T", err)
+	}
+	if apiErr.Status != http.StatusNotFound || apiErr.Code != CodeNotFound || apiErr.Message != "Key k not found" {
+		t.Errorf("Unexpected decoded error %+v", apiErr)
+	}
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+		t.Errorf("Error %v does not match its code only", err)
+	}
+
+	t.Run("Plain text body", func(t *testing.T) {
+		resp := &http.Response{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Body:       io.NopCloser(strings.NewReader("request too large\n")),
+		}
+		err := DecodeError(resp)
+		if !errors.Is(err, ErrTooLarge) || CodeOf(err) != CodeTooLarge {
+			t.Errorf("Unexpected code for %v", err)
+		}
+		if !strings.Contains(err.Error(), "request too large") {
+			t.Errorf("Body text is lost: %v", err)
+		}
+	})
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	rw := httptest.NewRecorder()
+	MethodNotAllowed(rw, httptest.NewRequest(http.MethodDelete, "/db/k", nil), http.MethodGet, http.MethodPost)
+
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", rw.Code)
+	}
+	if allow := rw.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("Unexpected Allow header %q", allow)
+	}
+	if CodeOf(DecodeError(rw.Result())) != CodeMethodNotAllowed {
+		t.Errorf("Unexpected error code")
+	}
+}
@@ -0,0 +1,336 @@
+// Package dbclient is a client of the HTTP API served by cmd/db.
+package dbclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+const (
+	defaultRetries    = 3
+	defaultBackoff    = 50 * time.Millisecond
+	defaultMaxBackoff = 2 * time.Second
+	scanPageSize      = 1000
+)
+
+// Error is what every request rejected by the server fails with; match it
+// against the sentinels with errors.Is.
+type Error = dbapi.Error
+
+var (
+	ErrNotFound  = dbapi.ErrNotFound
+	ErrCorrupted = dbapi.ErrCorrupted
+	ErrTooLarge  = dbapi.ErrTooLarge
+	ErrConflict  = dbapi.ErrConflict
+	// Returned once the retries are used up.
+	ErrRateLimited = dbapi.ErrRateLimited
+	ErrOverloaded  = dbapi.ErrOverloaded
+)
+
+type Client struct {
+	baseURL    string
+	http       *http.Client
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	apiKey     string
+	namespace  string
+	pageSize   int
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default client, which keeps a pool of idle
+// connections to the server.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.http = c
+	}
+}
+
+// WithRetries sets how many times a request failing with a network error,
+// 429, 502, 503 or 504 is repeated. Writes sent with POST are only repeated
+// after a 429 or 503, which the server answers without applying them, since
+// after the other failures they may have been applied already.
+func WithRetries(n int) Option {
+	return func(client *Client) {
+		client.retries = n
+	}
+}
+
+// WithBackoff sets the delay before the first retry, doubled for every next
+// one up to max.
+func WithBackoff(base, max time.Duration) Option {
+	return func(client *Client) {
+		client.backoff, client.maxBackoff = base, max
+	}
+}
+
+// WithAPIKey sends the secret as a bearer token.
+func WithAPIKey(secret string) Option {
+	return func(client *Client) {
+		client.apiKey = secret
+	}
+}
+
+// WithNamespace makes the client use the database of the namespace instead
+// of the default one.
+func WithNamespace(name string) Option {
+	return func(client *Client) {
+		client.namespace = name
+	}
+}
+
+// New creates a client of the server at baseURL, such as "http://db:8085".
+func New(baseURL string, opts ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+
+	c := &Client{
+		baseURL:    baseURL,
+		http:       &http.Client{Transport: transport},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+		maxBackoff: defaultMaxBackoff,
+		pageSize:   scanPageSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type valueBody struct {
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value"`
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var body valueBody
+	if err := c.call(ctx, http.MethodGet, keyPath(key), nil, nil, &body); err != nil {
+		return "", err
+	}
+	return body.Value, nil
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	return c.call(ctx, http.MethodPost, keyPath(key), nil, valueBody{Value: value}, nil)
+}
+
+// Delete removes the key; deleting a missing key is not an error.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, http.MethodDelete, keyPath(key), nil, nil, nil)
+}
+
+// MGet reads the keys at once. Missing keys are absent from the result.
+func (c *Client) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	var body struct {
+		Values map[string]string `json:"values"`
+	}
+	if err := c.call(ctx, http.MethodPost, "/_mget", nil, map[string][]string{"keys": keys}, &body); err != nil {
+		return nil, err
+	}
+	if body.Values == nil {
+		body.Values = make(map[string]string)
+	}
+	return body.Values, nil
+}
+
+// Scan calls fn for every key with the prefix in sorted order, stopping at
+// the first error fn returns. Keys are fetched in pages, each one retried on
+// its own, so a long scan survives a dropped connection.
+func (c *Client) Scan(ctx context.Context, prefix string, fn func(key, value string) error) error {
+	after := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "limit": {strconv.Itoa(c.pageSize)}}
+		if after != "" {
+			query.Set("after", after)
+		}
+
+		resp, err := c.do(ctx, http.MethodGet, "/_export", query, nil)
+		if err != nil {
+			return err
+		}
+
+		n, last, err := readPage(resp, fn)
+		if err != nil {
+			return err
+		}
+		if n < c.pageSize {
+			return nil
+		}
+		after = last
+	}
+}
+
+// readPage passes the records of an export to fn and returns how many there
+// were and the last key.
+func readPage(resp *http.Response, fn func(key, value string) error) (int, string, error) {
+	defer resp.Body.Close()
+
+	var (
+		n    int
+		last string
+	)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var kv valueBody
+		if err := json.Unmarshal(scanner.Bytes(), &kv); err != nil {
+			return n, last, fmt.Errorf("invalid scan record: %v", err)
+		}
+		if err := fn(kv.Key, kv.Value); err != nil {
+			return n, last, err
+		}
+		n++
+		last = kv.Key
+	}
+	if err := scanner.Err(); err != nil {
+		return n, last, err
+	}
+	if msg := resp.Trailer.Get("X-Export-Error"); msg != "" {
+		return n, last, &Error{Status: resp.StatusCode, Code: dbapi.CodeInternal, Message: msg}
+	}
+	return n, last, nil
+}
+
+// keyPath escapes the key into a single path segment, so keys with '/' and
+// other reserved characters arrive intact.
+func keyPath(key string) string {
+	return "/" + url.PathEscape(key)
+}
+
+// call sends in as JSON and decodes a successful response into out.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
+
+// do sends the request, retrying it with backoff, and returns a successful
+// response or the error of the last attempt.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	u := c.baseURL
+	if c.namespace != "" {
+		u += "/ns/" + url.PathEscape(c.namespace)
+	}
+	u += "/db" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	safe := idempotent(method, path)
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+
+		var wait time.Duration
+		resp, err := c.http.Do(req)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || !safe || attempt >= c.retries {
+				return nil, err
+			}
+		case resp.StatusCode < 300:
+			return resp, nil
+		case !retryable(resp.StatusCode, safe) || attempt >= c.retries:
+			err := dbapi.DecodeError(resp)
+			resp.Body.Close()
+			return nil, err
+		default:
+			wait = retryAfter(resp)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		if d := c.delay(attempt); d > wait {
+			wait = d
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// idempotent tells the requests that can be repeated whatever happened to
+// the previous attempt: the ones that are not POST, and the POST reads.
+func idempotent(method, path string) bool {
+	return method != http.MethodPost || path == "/_mget"
+}
+
+// retryable tells the failures worth another attempt. A 429 or 503 means the
+// request was turned away unapplied; a 502 or 504 leaves it unknown, so only
+// idempotent requests are repeated after those.
+func retryable(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// retryAfter reads the Retry-After header given in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// delay is the exponential backoff before the retry after the attempt, with
+// jitter so that clients failing together do not retry together.
+func (c *Client) delay(attempt int) time.Duration {
+	d := c.backoff << attempt
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
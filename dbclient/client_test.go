@@ -0,0 +1,252 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbserver"
+)
+
+// testServer runs the handlers of cmd/db on a fresh database.
+func testServer(t *testing.T) (http.Handler, *datastore.Namespaces) {
+	dir, err := ioutil.TempDir("", "client-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := datastore.NewDb(dir, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	namespaces, err := datastore.OpenNamespaces(filepath.Join(dir, "namespaces"), 4096, datastore.HashEngine, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { namespaces.Close() })
+
+	return dbserver.New(db, namespaces, dbserver.DefaultLimits()).Handler(), namespaces
+}
+
+func TestClient(t *testing.T) {
+	handler, namespaces := testServer(t)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	ctx := context.Background()
+	client := New(server.URL)
+
+	for key, value := range map[string]string{"key": "value", "a/b": "slash", "user:1 x": "spaces"} {
+		if err := client.Put(ctx, key, value); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+		if got, err := client.Get(ctx, key); err != nil || got != value {
+			t.Errorf("Get(%s) = %q, %v, expected %q", key, got, err, value)
+		}
+	}
+
+	if _, err := client.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	t.Run("Delete", func(t *testing.T) {
+		if err := client.Delete(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Get(ctx, "key"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+		if err := client.Delete(ctx, "key"); err != nil {
+			t.Errorf("Deleting a missing key failed: %v", err)
+		}
+	})
+
+	t.Run("MGet", func(t *testing.T) {
+		values, err := client.MGet(ctx, "a/b", "missing", "user:1 x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 2 || values["a/b"] != "slash" || values["user:1 x"] != "spaces" {
+			t.Errorf("Unexpected values %v", values)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		for i := 0; i < 25; i++ {
+			if err := client.Put(ctx, fmt.Sprintf("scan:%02d", i), fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Small pages make the scan resume after the last key a few times.
+		paged := New(server.URL)
+		paged.pageSize = 7
+
+		var keys []string
+		err := paged.Scan(ctx, "scan:", func(key, value string) error {
+			if value != fmt.Sprint(len(keys)) {
+				t.Errorf("Unexpected value %s of %s", value, key)
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 25 || keys[0] != "scan:00" || keys[24] != "scan:24" {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+
+		stop := errors.New("stop")
+		n := 0
+		err = paged.Scan(ctx, "scan:", func(string, string) error {
+			n++
+			if n == 10 {
+				return stop
+			}
+			return nil
+		})
+		if err != stop || n != 10 {
+			t.Errorf("Expected the scan to stop after 10 keys, got %d keys and %v", n, err)
+		}
+	})
+
+	t.Run("Namespace", func(t *testing.T) {
+		if _, err := namespaces.Create("orders", datastore.NamespaceConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		orders := New(server.URL, WithNamespace("orders"))
+		if err := orders.Put(ctx, "a/b", "order"); err != nil {
+			t.Fatal(err)
+		}
+		if value, _ := orders.Get(ctx, "a/b"); value != "order" {
+			t.Errorf("Unexpected value in the namespace: %s", value)
+		}
+		if value, _ := client.Get(ctx, "a/b"); value != "slash" {
+			t.Errorf("The namespace changed the default database: %s", value)
+		}
+	})
+
+	t.Run("Too large", func(t *testing.T) {
+		err := client.Put(ctx, "large", string(make([]byte, datastore.DefaultMaxValueSize+1)))
+		if !errors.Is(err, ErrTooLarge) {
+			t.Errorf("Expected ErrTooLarge, got %v", err)
+		}
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.Status != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %v", err)
+		}
+	})
+}
+
+func TestRetries(t *testing.T) {
+	handler, _ := testServer(t)
+
+	var requests, failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) <= failures.Load() {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client := New(server.URL, WithRetries(3), WithBackoff(time.Millisecond, 5*time.Millisecond))
+
+	failures.Store(3)
+	if err := client.Put(ctx, "key", "value"); err != nil {
+		t.Fatalf("Put failed despite retries: %v", err)
+	}
+	if n := requests.Load(); n != 4 {
+		t.Errorf("Expected 4 requests, got %d", n)
+	}
+
+	requests.Store(0)
+	failures.Store(10)
+	var apiErr *Error
+	if _, err := client.Get(ctx, "key"); !errors.As(err, &apiErr) || apiErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("Expected the 503 of the last attempt, got %v", err)
+	}
+	if n := requests.Load(); n != 4 {
+		t.Errorf("Expected 4 requests, got %d", n)
+	}
+
+	t.Run("Not found is not retried", func(t *testing.T) {
+		requests.Store(0)
+		failures.Store(0)
+		if _, err := client.Get(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("Expected 1 request, got %d", n)
+		}
+	})
+
+	t.Run("Writes are repeated only if unapplied", func(t *testing.T) {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if requests.Add(1) == 1 {
+				// The write may have gone through before the gateway failed.
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				rw.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			handler.ServeHTTP(rw, req)
+		}))
+		defer server.Close()
+		client := New(server.URL, WithRetries(3), WithBackoff(time.Millisecond, 5*time.Millisecond))
+
+		var apiErr *Error
+		if err := client.Put(ctx, "key", "value"); !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadGateway {
+			t.Errorf("Expected the 502 of the write, got %v", err)
+		}
+		if n := requests.Load(); n != 1 {
+			t.Errorf("Expected 1 request, got %d", n)
+		}
+
+		for name, read := range map[string]func() error{
+			"Get":  func() error { _, err := client.Get(ctx, "key"); return err },
+			"MGet": func() error { _, err := client.MGet(ctx, "key"); return err },
+			"Scan": func() error { return client.Scan(ctx, "", func(key, value string) error { return nil }) },
+		} {
+			requests.Store(0)
+			if err := read(); err != nil {
+				t.Errorf("%s failed despite retries: %v", name, err)
+			}
+			if n := requests.Load(); n != 2 {
+				t.Errorf("Expected 2 requests of %s, got %d", name, n)
+			}
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		requests.Store(0)
+		failures.Store(100)
+		slow := New(server.URL, WithRetries(100), WithBackoff(time.Second, time.Second))
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		if _, err := slow.Get(ctx, "key"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected the deadline to stop retries, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Retries went on for %v after the deadline", elapsed)
+		}
+	})
+}
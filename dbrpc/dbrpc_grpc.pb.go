@@ -0,0 +1,316 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: dbrpc.proto
+
+package dbrpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Datastore_Get_FullMethodName    = "/dbrpc.Datastore/Get"
+	Datastore_Put_FullMethodName    = "/dbrpc.Datastore/Put"
+	Datastore_Delete_FullMethodName = "/dbrpc.Datastore/Delete"
+	Datastore_Scan_FullMethodName   = "/dbrpc.Datastore/Scan"
+	Datastore_Watch_FullMethodName  = "/dbrpc.Datastore/Watch"
+)
+
+// DatastoreClient is the client API for Datastore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DatastoreClient interface {
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Scan streams the live keys in sorted order.
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Datastore_ScanClient, error)
+	// Watch streams the writes made after the call, until the client cancels.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Datastore_WatchClient, error)
+}
+
+type datastoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDatastoreClient(cc grpc.ClientConnInterface) DatastoreClient {
+	return &datastoreClient{cc}
+}
+
+func (c *datastoreClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Datastore_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *datastoreClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, Datastore_Put_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *datastoreClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, Datastore_Delete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *datastoreClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (Datastore_ScanClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Datastore_ServiceDesc.Streams[0], Datastore_Scan_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &datastoreScanClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Datastore_ScanClient interface {
+	Recv() (*KeyValue, error)
+	grpc.ClientStream
+}
+
+type datastoreScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *datastoreScanClient) Recv() (*KeyValue, error) {
+	m := new(KeyValue)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *datastoreClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Datastore_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Datastore_ServiceDesc.Streams[1], Datastore_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &datastoreWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Datastore_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type datastoreWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *datastoreWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DatastoreServer is the server API for Datastore service.
+// All implementations must embed UnimplementedDatastoreServer
+// for forward compatibility
+type DatastoreServer interface {
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Scan streams the live keys in sorted order.
+	Scan(*ScanRequest, Datastore_ScanServer) error
+	// Watch streams the writes made after the call, until the client cancels.
+	Watch(*WatchRequest, Datastore_WatchServer) error
+	mustEmbedUnimplementedDatastoreServer()
+}
+
+// UnimplementedDatastoreServer must be embedded to have forward compatible implementations.
+type UnimplementedDatastoreServer struct {
+}
+
+func (UnimplementedDatastoreServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedDatastoreServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedDatastoreServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedDatastoreServer) Scan(*ScanRequest, Datastore_ScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedDatastoreServer) Watch(*WatchRequest, Datastore_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedDatastoreServer) mustEmbedUnimplementedDatastoreServer() {}
+
+// UnsafeDatastoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DatastoreServer will
+// result in compilation errors.
+type UnsafeDatastoreServer interface {
+	mustEmbedUnimplementedDatastoreServer()
+}
+
+func RegisterDatastoreServer(s grpc.ServiceRegistrar, srv DatastoreServer) {
+	s.RegisterService(&Datastore_ServiceDesc, srv)
+}
+
+func _Datastore_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DatastoreServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Datastore_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DatastoreServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Datastore_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DatastoreServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Datastore_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DatastoreServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Datastore_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DatastoreServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Datastore_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DatastoreServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Datastore_Scan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DatastoreServer).Scan(m, &datastoreScanServer{stream})
+}
+
+type Datastore_ScanServer interface {
+	Send(*KeyValue) error
+	grpc.ServerStream
+}
+
+type datastoreScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *datastoreScanServer) Send(m *KeyValue) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Datastore_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DatastoreServer).Watch(m, &datastoreWatchServer{stream})
+}
+
+type Datastore_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type datastoreWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *datastoreWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Datastore_ServiceDesc is the grpc.ServiceDesc for Datastore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Datastore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dbrpc.Datastore",
+	HandlerType: (*DatastoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _Datastore_Get_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _Datastore_Put_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Datastore_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Scan",
+			Handler:       _Datastore_Scan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Datastore_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "dbrpc.proto",
+}
@@ -0,0 +1,154 @@
+// Package dbrpc serves the datastore over gRPC. The message and service
+// types are generated from dbrpc.proto.
+package dbrpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative dbrpc.proto
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scanPageSize is how many keys a scan lists from the database at a time.
+const scanPageSize = 1000
+
+type Server struct {
+	UnimplementedDatastoreServer
+
+	db *datastore.Db
+}
+
+func NewServer(db *datastore.Db) *Server {
+	return &Server{db: db}
+}
+
+// Register creates a gRPC server with the datastore service on it.
+func Register(db *datastore.Db, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(opts...)
+	RegisterDatastoreServer(s, NewServer(db))
+	return s
+}
+
+func (s *Server) Get(_ context.Context, req *GetRequest) (*GetResponse, error) {
+	value, version, err := s.db.GetVersioned(req.Key)
+	if err == datastore.ErrNotFound {
+		return nil, status.Errorf(codes.NotFound, "key %s not found", req.Key)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read key %s: %v", req.Key, err)
+	}
+	return &GetResponse{Key: req.Key, Value: value, Version: version}, nil
+}
+
+func (s *Server) Put(_ context.Context, req *PutRequest) (*PutResponse, error) {
+	if err := s.db.Put(req.Key, req.Value); err != nil {
+		return nil, status.Errorf(writeCode(err), "failed to store key %s: %v", req.Key, err)
+	}
+	return &PutResponse{}, nil
+}
+
+func (s *Server) Delete(_ context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if err := s.db.Delete(req.Key); err != nil {
+		return nil, status.Errorf(writeCode(err), "failed to delete key %s: %v", req.Key, err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+// writeCode tells writes rejected by the size limits or a full write queue
+// from storage failures.
+func writeCode(err error) codes.Code {
+	if errors.Is(err, datastore.ErrEmptyKey) || errors.Is(err, datastore.ErrKeyTooLarge) || errors.Is(err, datastore.ErrValueTooLarge) {
+		return codes.InvalidArgument
+	}
+	if errors.Is(err, datastore.ErrOverloaded) {
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
+
+func (s *Server) Scan(req *ScanRequest, stream Datastore_ScanServer) error {
+	sent := 0
+	// send streams the key and reports whether the limit is reached.
+	send := func(key string) (bool, error) {
+		value, err := s.db.Get(key)
+		if err == datastore.ErrNotFound {
+			// Deleted since the page was listed.
+			return false, nil
+		}
+		if err != nil {
+			return false, status.Errorf(codes.Internal, "failed to read key %s: %v", key, err)
+		}
+		if err := stream.Send(&KeyValue{Key: key, Value: value}); err != nil {
+			return false, err
+		}
+
+		sent++
+		return req.Limit > 0 && sent >= int(req.Limit), nil
+	}
+
+	after := req.After
+	if req.Prefix > after {
+		// No key before the prefix can match, and the prefix itself is the
+		// first key that does, so the listing starts right after it.
+		after = req.Prefix
+		if done, err := send(req.Prefix); done || err != nil {
+			return err
+		}
+	}
+
+	for {
+		keys, err := s.db.Keys(after, scanPageSize)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to list keys: %v", err)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, req.Prefix) {
+				// Sorted keys past the prefix can not match anymore.
+				return nil
+			}
+			if done, err := send(key); done || err != nil {
+				return err
+			}
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+func (s *Server) Watch(req *WatchRequest, stream Datastore_WatchServer) error {
+	events, stop := s.db.Watch(req.Prefix)
+	defer stop()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return status.Error(codes.Aborted, "watcher fell behind or the database was closed")
+			}
+
+			msg := &WatchEvent{
+				Type:    WatchEvent_PUT,
+				Key:     event.Key,
+				Value:   event.Value,
+				Version: event.Version,
+			}
+			if event.Deleted {
+				msg.Type = WatchEvent_DELETE
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
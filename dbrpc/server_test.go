@@ -0,0 +1,161 @@
+package dbrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startServer(t *testing.T) DatastoreClient {
+	dir, err := ioutil.TempDir("", "rpc-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := datastore.NewDb(dir, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := Register(db)
+	go server.Serve(lis)
+	t.Cleanup(func() {
+		server.Stop()
+		db.Close()
+	})
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return NewDatastoreClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	client := startServer(t)
+	ctx := context.Background()
+
+	t.Run("Put, get and delete", func(t *testing.T) {
+		if _, err := client.Put(ctx, &PutRequest{Key: "key", Value: "value"}); err != nil {
+			t.Fatal("Put failed:", err)
+		}
+
+		res, err := client.Get(ctx, &GetRequest{Key: "key"})
+		if err != nil || res.Value != "value" || res.Version == 0 {
+			t.Errorf("Unexpected get result %v (%v)", res, err)
+		}
+
+		if _, err := client.Delete(ctx, &DeleteRequest{Key: "key"}); err != nil {
+			t.Fatal("Delete failed:", err)
+		}
+		if _, err := client.Get(ctx, &GetRequest{Key: "key"}); status.Code(err) != codes.NotFound {
+			t.Errorf("Expected NotFound for deleted key, got %v", err)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			client.Put(ctx, &PutRequest{Key: fmt.Sprintf("scan%02d", i), Value: fmt.Sprintf("value%d", i)})
+		}
+		client.Put(ctx, &PutRequest{Key: "other", Value: "value"})
+
+		stream, err := client.Scan(ctx, &ScanRequest{After: "scan04", Prefix: "scan", Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for {
+			kv, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, kv.Key)
+		}
+
+		if len(keys) != 10 || keys[0] != "scan05" || keys[9] != "scan14" {
+			t.Errorf("Unexpected scanned keys %v", keys)
+		}
+	})
+
+	t.Run("Scan starts at the prefix", func(t *testing.T) {
+		client.Put(ctx, &PutRequest{Key: "scan", Value: "value"})
+
+		stream, err := client.Scan(ctx, &ScanRequest{Prefix: "scan", Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for {
+			kv, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, kv.Key)
+		}
+
+		if len(keys) != 2 || keys[0] != "scan" || keys[1] != "scan00" {
+			t.Errorf("Unexpected scanned keys %v", keys)
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		stream, err := client.Watch(ctx, &WatchRequest{Prefix: "watched"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The server registers the watcher once the stream is open.
+		time.Sleep(100 * time.Millisecond)
+
+		client.Put(ctx, &PutRequest{Key: "ignored", Value: "value"})
+		client.Put(ctx, &PutRequest{Key: "watched1", Value: "value1"})
+		client.Delete(ctx, &DeleteRequest{Key: "watched1"})
+
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != WatchEvent_PUT || event.Key != "watched1" || event.Value != "value1" {
+			t.Errorf("Unexpected event %v", event)
+		}
+
+		event, err = stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != WatchEvent_DELETE || event.Key != "watched1" {
+			t.Errorf("Unexpected event %v", event)
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package dbserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+// maxClockSkew bounds how old or early the timestamp of a signed request
+// may be, so a captured request can not be replayed later.
+const maxClockSkew = 5 * time.Minute
+
+// AuthConfig lists the API keys allowed to use the HTTP API.
+type AuthConfig struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// APIKey is presented either as "Authorization: Bearer <secret>" or used
+// to sign requests with "Authorization: HMAC <id>:<unix time>:<signature>",
+// the signature being the hex HMAC-SHA256 of the method, the request URI,
+// the timestamp and the hex SHA-256 of the body, joined by newlines.
+type APIKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	// Admin keys may manage namespaces and read metrics, and have every
+	// other permission.
+	Admin bool   `json:"admin,omitempty"`
+	Rules []Rule `json:"rules"`
+}
+
+// Rule grants access to the keys with the prefix in a namespace, the empty
+// namespace being the default database.
+type Rule struct {
+	Namespace string `json:"namespace,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	Read      bool   `json:"read,omitempty"`
+	Write     bool   `json:"write,omitempty"`
+}
+
+// LoadAuthConfig reads and checks a JSON file of API keys.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config AuthConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid auth config %s: %v", path, err)
+	}
+
+	ids := make(map[string]bool)
+	for _, key := range config.Keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, fmt.Errorf("invalid auth config %s: every key needs an id and a secret", path)
+		}
+		if ids[key.ID] {
+			return nil, fmt.Errorf("invalid auth config %s: duplicate key id %s", path, key.ID)
+		}
+		ids[key.ID] = true
+	}
+	return &config, nil
+}
+
+// access is what a request needs. With whole set it touches keys that are
+// only known from the body, so the rules have to cover the entire namespace.
+type access struct {
+	namespace string
+	key       string
+	whole     bool
+	read      bool
+	write     bool
+	admin     bool
+}
+
+func requiredAccess(req *http.Request) access {
+	path := req.URL.Path
+	if path == "/metrics" || strings.HasPrefix(path, "/db/_namespaces") {
+		return access{admin: true}
+	}
+
+	var acc access
+	if rest, ok := strings.CutPrefix(path, "/ns/"); ok {
+		acc.namespace, path, _ = strings.Cut(rest, "/")
+		path = "/" + path
+	}
+
+	switch path {
+	case "/db/_mget", "/db/_export", "/db/_stats":
+		acc.whole, acc.read = true, true
+	case "/db/_import":
+		acc.whole, acc.write = true, true
+	case "/db/_txn":
+		acc.whole, acc.read, acc.write = true, true, true
+	default:
+		acc.key = strings.TrimPrefix(path, "/db/")
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			acc.read = true
+		} else {
+			acc.write = true
+		}
+	}
+	return acc
+}
+
+func (k *APIKey) allows(acc access) bool {
+	if k.Admin {
+		return true
+	}
+	if acc.admin {
+		return false
+	}
+
+	read, write := !acc.read, !acc.write
+	for _, rule := range k.Rules {
+		if rule.Namespace != acc.namespace {
+			continue
+		}
+		if acc.whole && rule.Prefix != "" || !strings.HasPrefix(acc.key, rule.Prefix) {
+			continue
+		}
+		read = read || rule.Read
+		write = write || rule.Write
+	}
+	return read && write
+}
+
+// Authenticator checks the credentials of requests against the API keys and
+// writes a JSON line to the audit log for every request it denies.
+type Authenticator struct {
+	// MaxBodySize caps the bodies of signed requests, which are read into
+	// memory to be hashed. It defaults to the body limit of DefaultLimits.
+	MaxBodySize int64
+
+	keys  map[string]*APIKey
+	audit io.Writer
+	now   func() time.Time
+}
+
+func NewAuthenticator(config *AuthConfig, audit io.Writer) *Authenticator {
+	a := &Authenticator{
+		MaxBodySize: DefaultLimits().MaxBodySize,
+
+		keys:  make(map[string]*APIKey),
+		audit: audit,
+		now:   time.Now,
+	}
+	for i := range config.Keys {
+		a.keys[config.Keys[i].ID] = &config.Keys[i]
+	}
+	return a
+}
+
+// Wrap rejects requests without valid credentials with 401 and requests
+// the key has no permission for with 403, recording both in the audit log.
+func (a *Authenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		key, err := a.authenticate(rw, req)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			a.deny(req, "", http.StatusRequestEntityTooLarge, err.Error())
+			dbapi.WriteError(rw, http.StatusRequestEntityTooLarge, dbapi.CodeTooLarge, fmt.Sprintf("Signed request body is over the limit of %d bytes", tooLarge.Limit))
+			return
+		}
+		if err != nil {
+			a.deny(req, "", http.StatusUnauthorized, err.Error())
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+			dbapi.WriteError(rw, http.StatusUnauthorized, dbapi.CodeUnauthorized, err.Error())
+			return
+		}
+
+		if !key.allows(requiredAccess(req)) {
+			a.deny(req, key.ID, http.StatusForbidden, "no permission")
+			dbapi.WriteError(rw, http.StatusForbidden, dbapi.CodeForbidden, fmt.Sprintf("Key %s has no permission for this request", key.ID))
+			return
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (a *Authenticator) authenticate(rw http.ResponseWriter, req *http.Request) (*APIKey, error) {
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	switch scheme {
+	case "Bearer":
+		for _, key := range a.keys {
+			if subtle.ConstantTimeCompare([]byte(key.Secret), []byte(credentials)) == 1 {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown API key")
+	case "HMAC":
+		return a.verifySignature(rw, req, credentials)
+	case "":
+		return nil, fmt.Errorf("missing credentials")
+	}
+	return nil, fmt.Errorf("unsupported authorization scheme %q", scheme)
+}
+
+func (a *Authenticator) verifySignature(rw http.ResponseWriter, req *http.Request, credentials string) (*APIKey, error) {
+	parts := strings.Split(credentials, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed signature")
+	}
+
+	key, ok := a.keys[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown API key")
+	}
+
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature timestamp")
+	}
+	if skew := a.now().Sub(time.Unix(ts, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, fmt.Errorf("signature timestamp out of range")
+	}
+
+	// The body is read to be hashed and put back for the handler.
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, a.MaxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected, err := hex.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sign(key.Secret, req.Method, req.URL.RequestURI(), parts[1], body), expected) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return key, nil
+}
+
+func sign(secret, method, uri, timestamp string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", method, uri, timestamp, hex.EncodeToString(digest[:]))
+	return mac.Sum(nil)
+}
+
+type auditRecord struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Key    string    `json:"key,omitempty"`
+	Status int       `json:"status"`
+	Reason string    `json:"reason"`
+}
+
+func (a *Authenticator) deny(req *http.Request, keyID string, status int, reason string) {
+	_ = json.NewEncoder(a.audit).Encode(auditRecord{
+		Time:   a.now().UTC(),
+		Remote: req.RemoteAddr,
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Key:    keyID,
+		Status: status,
+		Reason: reason,
+	})
+}
@@ -0,0 +1,111 @@
+package dbserver
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAuthenticator(audit *bytes.Buffer) http.Handler {
+	config := &AuthConfig{Keys: []APIKey{
+		{ID: "users", Secret: "users-secret", Rules: []Rule{
+			{Prefix: "user:", Read: true, Write: true},
+			{Prefix: "", Read: true},
+		}},
+		{ID: "orders", Secret: "orders-secret", Rules: []Rule{
+			{Namespace: "orders", Read: true, Write: true},
+		}},
+		{ID: "admin", Secret: "admin-secret", Admin: true},
+	}}
+
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	return NewAuthenticator(config, audit).Wrap(ok)
+}
+
+func bearer(method, path, secret string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(`{"value":"v"}`))
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	return req
+}
+
+func TestAuthPermissions(t *testing.T) {
+	audit := new(bytes.Buffer)
+	handler := testAuthenticator(audit)
+
+	for _, tc := range []struct {
+		method, path, secret string
+		status               int
+	}{
+		{http.MethodGet, "/db/key", "", http.StatusUnauthorized},
+		{http.MethodGet, "/db/key", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/db/key", "users-secret", http.StatusOK},
+		{http.MethodPost, "/db/key", "users-secret", http.StatusForbidden},
+		{http.MethodPost, "/db/user:1", "users-secret", http.StatusOK},
+		{http.MethodPost, "/db/_mget", "users-secret", http.StatusOK},
+		{http.MethodPost, "/db/_import", "users-secret", http.StatusForbidden},
+		{http.MethodGet, "/ns/orders/db/key", "users-secret", http.StatusForbidden},
+		{http.MethodPost, "/ns/orders/db/key", "orders-secret", http.StatusOK},
+		{http.MethodPost, "/ns/orders/db/_txn", "orders-secret", http.StatusOK},
+		{http.MethodGet, "/db/key", "orders-secret", http.StatusForbidden},
+		{http.MethodPut, "/db/_namespaces/new", "orders-secret", http.StatusForbidden},
+		{http.MethodPut, "/db/_namespaces/new", "admin-secret", http.StatusOK},
+		{http.MethodGet, "/metrics", "admin-secret", http.StatusOK},
+	} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, bearer(tc.method, tc.path, tc.secret))
+		assert.Equal(t, tc.status, rw.Code, "%s %s with %q", tc.method, tc.path, tc.secret)
+	}
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	assert.Len(t, lines, 7, "every denied request is audited")
+	assert.Contains(t, lines[len(lines)-1], `"key":"orders"`)
+	assert.Contains(t, lines[len(lines)-1], `"status":403`)
+}
+
+func TestAuthSignature(t *testing.T) {
+	handler := testAuthenticator(new(bytes.Buffer))
+
+	signed := func(path, body string, at time.Time, secret string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		ts := strconv.FormatInt(at.Unix(), 10)
+		sig := hex.EncodeToString(sign(secret, http.MethodPost, path, ts, []byte(body)))
+		req.Header.Set("Authorization", fmt.Sprintf("HMAC users:%s:%s", ts, sig))
+		return req
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, signed("/db/user:1", `{"value":"v"}`, time.Now(), "users-secret"))
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, signed("/db/user:1", `{"value":"v"}`, time.Now(), "other-secret"))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code, "wrong secret")
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, signed("/db/user:1", `{"value":"v"}`, time.Now().Add(-time.Hour), "users-secret"))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code, "stale timestamp")
+
+	req := signed("/db/user:1", `{"value":"v"}`, time.Now(), "users-secret")
+	req.Body = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"value":"forged"}`)).Body
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code, "tampered body")
+
+	auth := NewAuthenticator(&AuthConfig{Keys: []APIKey{{ID: "users", Secret: "users-secret", Admin: true}}}, new(bytes.Buffer))
+	auth.MaxBodySize = 16
+	rw = httptest.NewRecorder()
+	auth.Wrap(http.NotFoundHandler()).ServeHTTP(rw, signed("/db/user:1", strings.Repeat("x", 17), time.Now(), "users-secret"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code, "body over the limit")
+}
@@ -0,0 +1,292 @@
+package dbserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+const (
+	importBatchSize = 256
+	exportPageSize  = 1000
+
+	// A JSON string takes up to 6 bytes for every byte it holds, as in
+	// \u0000, and a record adds its field names and punctuation.
+	jsonEscapeFactor     = 6
+	importRecordOverhead = 1 << 10
+)
+
+var errRecordTooLarge = errors.New("record is too large")
+
+// Records moved by all imports and exports since the start, exposed in /metrics.
+var (
+	importedRecords atomic.Uint64
+	exportedRecords atomic.Uint64
+)
+
+// ImportResponseStruct reports how far an import got. Processed counts the
+// input lines that are done with, including skipped ones, so an interrupted
+// import is resumed by sending the same stream again with ?skip=<processed>.
+type ImportResponseStruct struct {
+	Processed int          `json:"processed"`
+	Imported  int          `json:"imported"`
+	Skipped   int          `json:"skipped"`
+	LastKey   string       `json:"last_key,omitempty"`
+	Error     *dbapi.Error `json:"error,omitempty"`
+}
+
+type batchWriter interface {
+	PutBatch(pairs []datastore.KeyValue) error
+}
+
+// exporter lists the live keys in sorted order, as Db does.
+type exporter interface {
+	datastore.Engine
+	Keys(after string, limit int) ([]string, error)
+	Stats() datastore.Stats
+}
+
+func putBatch(engine datastore.Engine, pairs []datastore.KeyValue) error {
+	if w, ok := engine.(batchWriter); ok {
+		return w.PutBatch(pairs)
+	}
+	for _, kv := range pairs {
+		if err := engine.Put(kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleImportRequest stores a stream of newline-delimited {"key","value"}
+// records, committing them in batches. The stream is not limited, but every
+// line is, by the largest record the key and value limits allow.
+func (s *Server) handleImportRequest(rw http.ResponseWriter, req *http.Request, engine datastore.Engine) {
+	if req.Method != http.MethodPost {
+		dbapi.MethodNotAllowed(rw, req, http.MethodPost)
+		return
+	}
+
+	skip := 0
+	if v := req.URL.Query().Get("skip"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			dbapi.WriteError(rw, http.StatusBadRequest, dbapi.CodeBadRequest, fmt.Sprintf("Invalid skip %q", v))
+			return
+		}
+		skip = n
+	}
+	maxRecord := jsonEscapeFactor*(s.limits.MaxKeySize+s.limits.MaxValueSize) + importRecordOverhead
+
+	var (
+		res   ImportResponseStruct
+		batch []datastore.KeyValue
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := putBatch(engine, batch); err != nil {
+			return err
+		}
+		res.Processed += len(batch)
+		res.Imported += len(batch)
+		res.LastKey = batch[len(batch)-1].Key
+		importedRecords.Add(uint64(len(batch)))
+		batch = batch[:0]
+		return nil
+	}
+	fail := func(err error) {
+		status, code := errorStatus(err)
+		setRetryAfter(rw, status)
+		res.Error = &dbapi.Error{Code: code, Message: err.Error()}
+		writeImportResponse(rw, status, res)
+	}
+
+	in := bufio.NewReader(req.Body)
+	for line := 0; ; line++ {
+		data, err := readRecord(in, maxRecord)
+		if err == io.EOF {
+			break
+		}
+		var kv datastore.KeyValue
+		if err == nil {
+			err = json.Unmarshal(data, &kv)
+		}
+		if err != nil {
+			// Keep what was read before the broken line.
+			if err := flush(); err != nil {
+				fail(err)
+				return
+			}
+			status, code := http.StatusBadRequest, dbapi.CodeBadRequest
+			if err == errRecordTooLarge {
+				status, code = http.StatusRequestEntityTooLarge, dbapi.CodeTooLarge
+				err = fmt.Errorf("%w, the limit is %d bytes", err, maxRecord)
+			}
+			res.Error = &dbapi.Error{Code: code, Message: fmt.Sprintf("invalid record %d: %v", line, err)}
+			writeImportResponse(rw, status, res)
+			return
+		}
+
+		if line < skip {
+			res.Processed++
+			res.Skipped++
+			continue
+		}
+
+		batch = append(batch, kv)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				fail(err)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		fail(err)
+		return
+	}
+
+	writeImportResponse(rw, http.StatusOK, res)
+}
+
+// readRecord reads the next line that is not blank. A line may be up to max
+// bytes long, the last one may lack the newline.
+func readRecord(r *bufio.Reader, max int) ([]byte, error) {
+	for {
+		var line []byte
+		for {
+			chunk, err := r.ReadSlice('\n')
+			if len(line)+len(bytes.TrimSuffix(chunk, []byte("\n"))) > max {
+				return nil, errRecordTooLarge
+			}
+			line = append(line, chunk...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && (err != io.EOF || len(line) == 0) {
+				return nil, err
+			}
+			break
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+func writeImportResponse(rw http.ResponseWriter, status int, res ImportResponseStruct) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(res)
+}
+
+// handleExportRequest streams the live keys in sorted order as
+// newline-delimited {"key","value"} records. An interrupted export is resumed
+// with ?after=<last received key>, ?prefix= restricts it to the keys with the
+// prefix and ?limit= stops it after as many records. X-Export-Keys carries
+// the number of live keys when the export started and the X-Export-Count
+// trailer the number of records sent.
+func handleExportRequest(rw http.ResponseWriter, req *http.Request, engine datastore.Engine) {
+	if req.Method != http.MethodGet {
+		dbapi.MethodNotAllowed(rw, req, http.MethodGet)
+		return
+	}
+
+	db, ok := engine.(exporter)
+	if !ok {
+		dbapi.WriteError(rw, http.StatusNotImplemented, dbapi.CodeNotImplemented, "Export is not supported by the storage engine")
+		return
+	}
+
+	query := req.URL.Query()
+	after, prefix := query.Get("after"), query.Get("prefix")
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			dbapi.WriteError(rw, http.StatusBadRequest, dbapi.CodeBadRequest, fmt.Sprintf("Invalid limit %q", l))
+			return
+		}
+		limit = n
+	}
+	flusher, _ := rw.(http.Flusher)
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.Header().Set("Trailer", "X-Export-Count, X-Export-Error")
+	rw.Header().Set("X-Export-Keys", strconv.FormatInt(db.Stats().Keys, 10))
+	rw.WriteHeader(http.StatusOK)
+
+	count := 0
+	defer func() {
+		rw.Header().Set("X-Export-Count", strconv.Itoa(count))
+	}()
+
+	enc := json.NewEncoder(rw)
+	// send writes the record of the key and reports whether the export is
+	// over, because of the limit or a failure.
+	send := func(key string) bool {
+		value, err := db.Get(key)
+		if err == datastore.ErrNotFound {
+			// Deleted since the page was listed.
+			return false
+		}
+		if err != nil {
+			rw.Header().Set("X-Export-Error", err.Error())
+			return true
+		}
+		if err := enc.Encode(datastore.KeyValue{Key: key, Value: value}); err != nil {
+			// The client went away.
+			return true
+		}
+		count++
+		exportedRecords.Add(1)
+		return limit > 0 && count >= limit
+	}
+
+	if prefix > after {
+		// No key before the prefix can match, and the prefix itself is the
+		// first key that does, so the listing starts right after it.
+		after = prefix
+		if send(prefix) {
+			return
+		}
+	}
+
+	for {
+		keys, err := db.Keys(after, exportPageSize)
+		if err != nil {
+			rw.Header().Set("X-Export-Error", err.Error())
+			return
+		}
+		if len(keys) == 0 {
+			return
+		}
+
+		for _, key := range keys {
+			if !strings.HasPrefix(key, prefix) {
+				// Sorted keys past the prefix can not match anymore.
+				return
+			}
+			if send(key) {
+				return
+			}
+		}
+
+		after = keys[len(keys)-1]
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package dbserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bulk-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	limits := DefaultLimits()
+	limits.MaxValueSize = 10
+	db, err := datastore.NewDbWithOptions(dir, 4096, limits.Options())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	routes := New(db, nil, limits).routes(db)
+
+	imp := func(query, body string) (int, ImportResponseStruct) {
+		rw := httptest.NewRecorder()
+		routes.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/_import"+query, strings.NewReader(body)))
+
+		var res ImportResponseStruct
+		if rw.Code != http.StatusMethodNotAllowed {
+			assert.NoError(t, json.NewDecoder(rw.Body).Decode(&res))
+		}
+		return rw.Code, res
+	}
+	records := `{"key":"a","value":"1"}` + "\n" + `{"key":"b","value":"2"}` + "\n" + `{"key":"c","value":"3"}` + "\n"
+
+	t.Run("Import", func(t *testing.T) {
+		code, res := imp("", records)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, ImportResponseStruct{Processed: 3, Imported: 3, LastKey: "c"}, res)
+
+		value, err := db.Get("b")
+		assert.NoError(t, err)
+		assert.Equal(t, "2", value)
+	})
+
+	t.Run("Resumed import", func(t *testing.T) {
+		code, res := imp("?skip=2", records)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, ImportResponseStruct{Processed: 3, Imported: 1, Skipped: 2, LastKey: "c"}, res)
+
+		code, _ = imp("?skip=-1", records)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("Broken record", func(t *testing.T) {
+		code, res := imp("", `{"key":"d","value":"4"}`+"\n"+`{"key":"e",`)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, 1, res.Imported, "records before the broken one are kept")
+		if assert.NotNil(t, res.Error) {
+			assert.Equal(t, dbapi.CodeBadRequest, res.Error.Code)
+		}
+
+		_, err := db.Get("d")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Rejected record", func(t *testing.T) {
+		code, res := imp("", `{"key":"f","value":"value over the limit"}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+		assert.Zero(t, res.Imported)
+		if assert.NotNil(t, res.Error) {
+			assert.Equal(t, dbapi.CodeTooLarge, res.Error.Code)
+		}
+	})
+
+	t.Run("Oversized record", func(t *testing.T) {
+		line := &countingReader{r: io.LimitReader(repeatReader('x'), 64<<20)}
+		body := io.MultiReader(strings.NewReader(`{"key":"g","value":"7"}`+"\n\n"+`{"key":"h","value":"`), line)
+
+		rw := httptest.NewRecorder()
+		routes.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/_import", body))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+		assert.Less(t, line.n, int64(1<<20), "the line is cut off before its end is read")
+
+		var res ImportResponseStruct
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&res))
+		assert.Equal(t, 1, res.Imported, "records before the oversized one are kept")
+		if assert.NotNil(t, res.Error) {
+			assert.Equal(t, dbapi.CodeTooLarge, res.Error.Code)
+		}
+	})
+
+	t.Run("Method", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		routes.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db/_import", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		server := httptest.NewServer(routes)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/db/_export?after=a&limit=2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+		var keys []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var kv datastore.KeyValue
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &kv))
+			keys = append(keys, kv.Key)
+		}
+		assert.Equal(t, []string{"b", "c"}, keys)
+		assert.Equal(t, "2", resp.Trailer.Get("X-Export-Count"))
+	})
+}
+
+// repeatReader reads the same byte over and over.
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// listingDb records where every listing of the keys starts.
+type listingDb struct {
+	*datastore.Db
+	starts []string
+}
+
+func (db *listingDb) Keys(after string, limit int) ([]string, error) {
+	db.starts = append(db.starts, after)
+	return db.Db.Keys(after, limit)
+}
+
+func TestExportPrefix(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pairs := make([]datastore.KeyValue, 0, exportPageSize+3)
+	for i := 0; i < exportPageSize; i++ {
+		pairs = append(pairs, datastore.KeyValue{Key: fmt.Sprintf("a%04d", i), Value: "before"})
+	}
+	pairs = append(pairs,
+		datastore.KeyValue{Key: "user", Value: "0"},
+		datastore.KeyValue{Key: "user:1", Value: "1"},
+		datastore.KeyValue{Key: "z", Value: "after"},
+	)
+	if err := db.PutBatch(pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(query string) (*listingDb, []string) {
+		listing := &listingDb{Db: db}
+		rw := httptest.NewRecorder()
+		handleExportRequest(rw, httptest.NewRequest(http.MethodGet, "/db/_export"+query, nil), listing)
+		assert.Equal(t, http.StatusOK, rw.Code)
+
+		var keys []string
+		scanner := bufio.NewScanner(rw.Body)
+		for scanner.Scan() {
+			var kv datastore.KeyValue
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &kv))
+			keys = append(keys, kv.Key)
+		}
+		return listing, keys
+	}
+
+	listing, keys := export("?prefix=user")
+	assert.Equal(t, []string{"user", "user:1"}, keys)
+	assert.Equal(t, []string{"user"}, listing.starts, "the listing starts at the prefix")
+
+	_, keys = export("?prefix=user&limit=1")
+	assert.Equal(t, []string{"user"}, keys)
+
+	listing, keys = export("?prefix=user&after=user")
+	assert.Equal(t, []string{"user:1"}, keys)
+	assert.Equal(t, []string{"user"}, listing.starts)
+}
@@ -0,0 +1,71 @@
+package dbserver
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "errors-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	routes := New(db, nil, DefaultLimits()).routes(db)
+
+	do := func(method, path, body string) *http.Response {
+		rw := httptest.NewRecorder()
+		routes.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rw.Result()
+	}
+
+	resp := do(http.MethodGet, "/db/missing", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.True(t, errors.Is(dbapi.DecodeError(resp), dbapi.ErrNotFound))
+
+	resp = do(http.MethodPut, "/db/key", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, POST, DELETE", resp.Header.Get("Allow"))
+
+	resp = do(http.MethodGet, "/db/_txn", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "POST", resp.Header.Get("Allow"))
+
+	resp = do(http.MethodPost, "/db/_txn", `{"conditions":[{"key":"key","exists":true}]}`)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.True(t, errors.Is(dbapi.DecodeError(resp), dbapi.ErrConflict))
+
+	t.Run("Corrupted record", func(t *testing.T) {
+		assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/db/key", `{"value":"value"}`).StatusCode)
+
+		// Flip a byte of the value, so the record fails its checksum.
+		path := dir + "/current-data0"
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)-21] ^= 0xff
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := do(http.MethodGet, "/db/key", "")
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Equal(t, dbapi.CodeCorrupted, dbapi.CodeOf(dbapi.DecodeError(resp)))
+	})
+}
@@ -0,0 +1,136 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+// Limits bounds the keys, values and request bodies the API accepts.
+type Limits struct {
+	MaxKeySize   int
+	MaxValueSize int
+	// MaxBodySize caps JSON request bodies; bulk imports are streamed and
+	// only their records are limited, by the key and value sizes.
+	MaxBodySize int64
+}
+
+// DefaultLimits are the limits of the datastore with an 8 MiB body cap.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxKeySize:   datastore.DefaultMaxKeySize,
+		MaxValueSize: datastore.DefaultMaxValueSize,
+		MaxBodySize:  8 << 20,
+	}
+}
+
+// Options are the datastore options enforcing the same key and value limits.
+func (l Limits) Options() datastore.Options {
+	return datastore.Options{MaxKeySize: l.MaxKeySize, MaxValueSize: l.MaxValueSize}
+}
+
+var (
+	errEmptyKey     = errors.New("key is empty")
+	errNestedKey    = errors.New("key contains an unescaped '/', send it as %2F")
+	errKeyTooLarge  = errors.New("key is too large")
+	errKeyMalformed = errors.New("key is not properly percent-encoded")
+)
+
+// parseKey takes the key from the path after /db/. The key is a single path
+// segment: it is percent-decoded once, so any byte, '/' included, can be
+// sent escaped, while a raw '/' is rejected instead of being taken as part
+// of the key.
+func (s *Server) parseKey(req *http.Request) (string, error) {
+	raw := strings.TrimPrefix(req.URL.EscapedPath(), "/db/")
+	if raw == "" {
+		return "", errEmptyKey
+	}
+	if strings.Contains(raw, "/") {
+		return "", errNestedKey
+	}
+
+	key, err := url.PathUnescape(raw)
+	if err != nil {
+		return "", errKeyMalformed
+	}
+	if key == "" {
+		return "", errEmptyKey
+	}
+	if len(key) > s.limits.MaxKeySize {
+		return "", fmt.Errorf("%w: %d bytes, the limit is %d", errKeyTooLarge, len(key), s.limits.MaxKeySize)
+	}
+	return key, nil
+}
+
+func writeKeyError(rw http.ResponseWriter, err error) {
+	code := dbapi.CodeInvalidKey
+	if errors.Is(err, errKeyTooLarge) {
+		code = dbapi.CodeTooLarge
+	}
+	dbapi.WriteError(rw, http.StatusBadRequest, code, fmt.Sprintf("Invalid key: %v", err))
+}
+
+// decodeBody reads a JSON body of at most MaxBodySize bytes, answering 413
+// for a larger one and 400 for a malformed one.
+func (s *Server) decodeBody(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	body := http.MaxBytesReader(rw, req.Body, s.limits.MaxBodySize)
+	err := json.NewDecoder(body).Decode(v)
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		dbapi.WriteError(rw, http.StatusRequestEntityTooLarge, dbapi.CodeTooLarge, fmt.Sprintf("Request body is over the limit of %d bytes", tooLarge.Limit))
+		return false
+	}
+	if err != nil {
+		dbapi.WriteError(rw, http.StatusBadRequest, dbapi.CodeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// errorStatus maps datastore errors to a status and an error code: writes
+// over the limits are the client's fault, a full write queue asks to retry
+// later, corrupted records and every other failure of the storage are 500.
+func errorStatus(err error) (int, dbapi.ErrorCode) {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		return http.StatusNotFound, dbapi.CodeNotFound
+	case errors.Is(err, datastore.ErrConflict):
+		return http.StatusConflict, dbapi.CodeConflict
+	case errors.Is(err, datastore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge, dbapi.CodeTooLarge
+	case errors.Is(err, datastore.ErrKeyTooLarge):
+		return http.StatusBadRequest, dbapi.CodeTooLarge
+	case errors.Is(err, datastore.ErrEmptyKey):
+		return http.StatusBadRequest, dbapi.CodeInvalidKey
+	case errors.Is(err, datastore.ErrOverloaded):
+		return http.StatusTooManyRequests, dbapi.CodeOverloaded
+	case errors.Is(err, datastore.ErrCorrupted):
+		return http.StatusInternalServerError, dbapi.CodeCorrupted
+	}
+	return http.StatusInternalServerError, dbapi.CodeInternal
+}
+
+func writeStorageError(rw http.ResponseWriter, err error, message string) {
+	status, code := errorStatus(err)
+	setRetryAfter(rw, status)
+	dbapi.WriteError(rw, status, code, fmt.Sprintf("%s: %v", message, err))
+}
+
+// setRetryAfter tells clients turned away with 429 to come back in a second,
+// by when the write queue has usually drained.
+func setRetryAfter(rw http.ResponseWriter, status int) {
+	if status == http.StatusTooManyRequests {
+		rw.Header().Set("Retry-After", "1")
+	}
+}
+
+func writeWriteError(rw http.ResponseWriter, err error) {
+	writeStorageError(rw, err, "Failed to store value")
+}
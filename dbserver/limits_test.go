@@ -0,0 +1,73 @@
+package dbserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKey(t *testing.T) {
+	s := New(nil, nil, DefaultLimits())
+	for _, tc := range []struct {
+		path, key string
+		err       error
+	}{
+		{"/db/key", "key", nil},
+		{"/db/user%3A1", "user:1", nil},
+		{"/db/a%2Fb", "a/b", nil},
+		{"/db/a%20b", "a b", nil},
+		{"/db/", "", errEmptyKey},
+		{"/db/a/b", "", errNestedKey},
+		{"/db/" + strings.Repeat("k", datastore.DefaultMaxKeySize+1), "", errKeyTooLarge},
+	} {
+		key, err := s.parseKey(httptest.NewRequest(http.MethodGet, tc.path, nil))
+		assert.ErrorIs(t, err, tc.err, tc.path)
+		assert.Equal(t, tc.key, key, tc.path)
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "limits-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	routes := New(db, nil, Limits{MaxKeySize: 16, MaxValueSize: 10, MaxBodySize: 100}).routes(db)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		routes.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rw
+	}
+
+	assert.Equal(t, http.StatusCreated, post("/db/key", `{"value":"small"}`).Code)
+
+	rw := post("/db/key", `{"value":"too large value"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), `"error":`)
+
+	rw = post("/db/key", `{"value":"`+strings.Repeat("x", 200)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code, "body over the cap")
+
+	assert.Equal(t, http.StatusBadRequest, post("/db/", `{"value":"v"}`).Code, "empty key")
+	assert.Equal(t, http.StatusBadRequest, post("/db/a/b", `{"value":"v"}`).Code, "nested key")
+	assert.Equal(t, http.StatusBadRequest, post("/db/key", `{"value":`).Code, "malformed body")
+
+	assert.Equal(t, http.StatusCreated, post("/db/a%2Fb", `{"value":"slash"}`).Code)
+	value, err := db.Get("a/b")
+	assert.NoError(t, err)
+	assert.Equal(t, "slash", value)
+}
@@ -0,0 +1,96 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+func statsOf(rw http.ResponseWriter, engine datastore.Engine) (datastore.Stats, bool) {
+	db, ok := engine.(*datastore.Db)
+	if !ok {
+		dbapi.WriteError(rw, http.StatusNotImplemented, dbapi.CodeNotImplemented, "Statistics are not supported by the storage engine")
+		return datastore.Stats{}, false
+	}
+	return db.Stats(), true
+}
+
+func handleStatsRequest(rw http.ResponseWriter, req *http.Request, engine datastore.Engine) {
+	if req.Method != http.MethodGet {
+		dbapi.MethodNotAllowed(rw, req, http.MethodGet)
+		return
+	}
+
+	stats, ok := statsOf(rw, engine)
+	if !ok {
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(stats)
+}
+
+// handleMetricsRequest exposes the database statistics in the Prometheus
+// text format.
+func handleMetricsRequest(rw http.ResponseWriter, _ *http.Request, engine datastore.Engine) {
+	stats, ok := statsOf(rw, engine)
+	if !ok {
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	rw.WriteHeader(http.StatusOK)
+	writeMetrics(rw, stats)
+}
+
+func writeMetrics(w io.Writer, stats datastore.Stats) {
+	metric := func(name, kind, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatFloat(value))
+	}
+
+	metric("db_keys", "gauge", "Number of live keys.", float64(stats.Keys))
+	metric("db_segments", "gauge", "Number of live segments.", float64(len(stats.Segments)))
+
+	fmt.Fprintf(w, "# HELP db_segment_bytes Size of a segment file.\n# TYPE db_segment_bytes gauge\n")
+	for _, s := range stats.Segments {
+		fmt.Fprintf(w, "db_segment_bytes{segment=%q} %d\n", s.Name, s.Size)
+	}
+
+	metric("db_live_bytes", "gauge", "Bytes taken by the latest records of live keys.", float64(stats.LiveBytes))
+	metric("db_dead_bytes", "gauge", "Bytes taken by overwritten and deleted records.", float64(stats.DeadBytes))
+	metric("db_compactions_total", "counter", "Number of finished compactions.", float64(stats.Compactions))
+	metric("db_last_compaction_duration_seconds", "gauge", "Duration of the last compaction.", stats.LastCompaction.Seconds())
+
+	histogram(w, "db_read_duration_seconds", "Latency of reads.", stats.Reads)
+	histogram(w, "db_write_duration_seconds", "Latency of writes.", stats.Writes)
+
+	metric("db_bloom_negatives_total", "counter", "Segment lookups skipped by bloom filters.", float64(stats.BloomNegatives))
+	metric("db_bloom_false_positives_total", "counter", "Segment lookups bloom filters failed to skip.", float64(stats.BloomFalsePositives))
+	metric("db_bloom_false_positive_ratio", "gauge", "Share of lookups of absent keys bloom filters failed to skip.", stats.BloomFalsePositiveRate)
+
+	metric("db_queued_writes", "gauge", "Writes waiting for the writer.", float64(stats.QueuedWrites))
+	metric("db_rejected_writes_total", "counter", "Writes rejected because the write queue was full.", float64(stats.RejectedWrites))
+	metric("db_rate_limited_requests_total", "counter", "Writes rejected by the per-client rate limit.", float64(rateLimitedRequests.Load()))
+
+	metric("db_import_records_total", "counter", "Records stored by bulk imports.", float64(importedRecords.Load()))
+	metric("db_export_records_total", "counter", "Records sent by bulk exports.", float64(exportedRecords.Load()))
+}
+
+func histogram(w io.Writer, name, help string, h datastore.HistogramSnapshot) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, b := range h.Buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(b.UpperBound), b.Count)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.Sum), name, h.Count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
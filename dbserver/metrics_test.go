@@ -0,0 +1,78 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stats-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	assert.NoError(t, db.Put("k1", "v1"))
+	assert.NoError(t, db.Put("k2", "v2"))
+	assert.NoError(t, db.Put("k1", "v3"))
+	handler := New(db, nil, DefaultLimits()).Handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		return rw
+	}
+
+	t.Run("Stats", func(t *testing.T) {
+		rw := get("/db/_stats")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+
+		var stats datastore.Stats
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&stats))
+		assert.Equal(t, int64(2), stats.Keys)
+		assert.NotEmpty(t, stats.Segments)
+		assert.Greater(t, stats.LiveBytes, int64(0))
+		assert.Greater(t, stats.DeadBytes, int64(0), "the overwritten value is dead")
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		rw := get("/metrics")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "text/plain; version=0.0.4", rw.Header().Get("Content-Type"))
+
+		body := rw.Body.String()
+		assert.Contains(t, body, "# TYPE db_keys gauge\ndb_keys 2\n")
+		assert.Contains(t, body, "# TYPE db_live_bytes gauge\n")
+		assert.Contains(t, body, `db_segment_bytes{segment="`)
+		assert.Contains(t, body, `db_write_duration_seconds_bucket{le="+Inf"} 3`)
+		assert.Contains(t, body, "db_write_duration_seconds_count 3\n")
+	})
+
+	t.Run("Unsupported engine", func(t *testing.T) {
+		lsm, err := datastore.NewLSM(t.TempDir(), datastore.LSMOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lsm.Close()
+		handler := New(lsm, nil, DefaultLimits()).Handler()
+
+		for _, path := range []string{"/db/_stats", "/metrics"} {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+			assert.Equal(t, http.StatusNotImplemented, rw.Code, path)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package dbserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+// handleNamespacesRequest lists the namespaces.
+func handleNamespacesRequest(rw http.ResponseWriter, req *http.Request, namespaces *datastore.Namespaces) {
+	if req.Method != http.MethodGet {
+		dbapi.MethodNotAllowed(rw, req, http.MethodGet)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(namespaces.List())
+}
+
+// handleNamespaceRequest creates a namespace on PUT, with an optional
+// {"segment_size": ...} body, and drops it with all its data on DELETE.
+func handleNamespaceRequest(rw http.ResponseWriter, req *http.Request, namespaces *datastore.Namespaces) {
+	name := strings.TrimPrefix(req.URL.Path, "/db/_namespaces/")
+
+	switch req.Method {
+	case http.MethodPut:
+		var config datastore.NamespaceConfig
+		if err := json.NewDecoder(req.Body).Decode(&config); err != nil && err != io.EOF {
+			dbapi.WriteError(rw, http.StatusBadRequest, dbapi.CodeBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+
+		_, err := namespaces.Create(name, config)
+		switch err {
+		case nil:
+			rw.WriteHeader(http.StatusCreated)
+		case datastore.ErrNamespaceExists:
+			rw.WriteHeader(http.StatusOK)
+		case datastore.ErrNamespaceDropping:
+			dbapi.WriteError(rw, http.StatusConflict, dbapi.CodeConflict, fmt.Sprintf("Namespace %s is being dropped", name))
+		case datastore.ErrInvalidNamespace:
+			dbapi.WriteError(rw, http.StatusBadRequest, dbapi.CodeBadRequest, fmt.Sprintf("Invalid namespace name: %v", err))
+		default:
+			dbapi.WriteError(rw, http.StatusInternalServerError, dbapi.CodeInternal, fmt.Sprintf("Failed to create namespace: %v", err))
+		}
+	case http.MethodDelete:
+		err := namespaces.Drop(name)
+		switch err {
+		case nil:
+			rw.WriteHeader(http.StatusNoContent)
+		case datastore.ErrNamespaceNotFound:
+			dbapi.WriteError(rw, http.StatusNotFound, dbapi.CodeNotFound, fmt.Sprintf("Namespace %s not found", name))
+		default:
+			dbapi.WriteError(rw, http.StatusInternalServerError, dbapi.CodeInternal, fmt.Sprintf("Failed to drop namespace: %v", err))
+		}
+	default:
+		dbapi.MethodNotAllowed(rw, req, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// handleNamespacedRequest serves /ns/<name>/db/... with the same API as
+// /db/..., on the database of the namespace.
+func (s *Server) handleNamespacedRequest(rw http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/ns/")
+	name, rest, ok := strings.Cut(path, "/")
+	if !ok || !strings.HasPrefix("/"+rest, "/db/") {
+		dbapi.WriteError(rw, http.StatusNotFound, dbapi.CodeNotFound, fmt.Sprintf("No such path %s", req.URL.Path))
+		return
+	}
+
+	db, release, err := s.namespaces.Get(name)
+	if err != nil {
+		dbapi.WriteError(rw, http.StatusNotFound, dbapi.CodeNotFound, fmt.Sprintf("Namespace %s not found", name))
+		return
+	}
+	defer release()
+
+	http.StripPrefix("/ns/"+name, s.routes(db)).ServeHTTP(rw, req)
+}
@@ -0,0 +1,49 @@
+package dbserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaces(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	namespaces, err := datastore.OpenNamespaces(t.TempDir(), 4096, datastore.HashEngine, datastore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer namespaces.Close()
+	handler := New(db, namespaces, DefaultLimits()).Handler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rw
+	}
+
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/db/_namespaces/users", "").Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "/db/_namespaces/users", "").Code, "creating it again")
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/db/_namespaces/a.b", "").Code)
+
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/ns/users/db/key", `{"value":"in users"}`).Code)
+	rw := do(http.MethodGet, "/ns/users/db/key", "")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "in users")
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/db/key", "").Code, "namespaces are separate from the default database")
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/db/_namespaces/users", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/ns/users/db/key", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/db/_namespaces/users", "").Code, "dropping it again")
+
+	// A namespace created again with the same name starts empty.
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/db/_namespaces/users", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/ns/users/db/key", "").Code)
+}
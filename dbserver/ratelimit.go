@@ -0,0 +1,115 @@
+package dbserver
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+// Requests turned away by rate limiters since the start, exposed in /metrics.
+var rateLimitedRequests atomic.Uint64
+
+// RateLimiter gives every client a token bucket refilled at rate tokens a
+// second up to burst. Each write request takes a token, reads are not
+// limited, including reads sent as POST such as /db/_mget. Clients are told
+// apart by their IP address.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Wrap answers 429 with Retry-After to writes of clients out of tokens.
+func (l *RateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !requiredAccess(req).write {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		if wait := l.take(clientOf(req)); wait > 0 {
+			rateLimitedRequests.Add(1)
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			dbapi.WriteError(rw, http.StatusTooManyRequests, dbapi.CodeRateLimited,
+				fmt.Sprintf("Too many writes, retry in %v", wait.Round(time.Millisecond)))
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// take spends a token of the client, returning how long to wait for one if
+// there are none.
+func (l *RateLimiter) take(client string) time.Duration {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// sweep forgets the clients whose buckets have refilled, so the map does not
+// grow with every address ever seen.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func clientOf(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,66 @@
+package dbserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	handler := limiter.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	doPath := func(method, path, remote string) *http.Response {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"value":"v"}`))
+		req.RemoteAddr = remote
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Result()
+	}
+	do := func(method, remote string) *http.Response {
+		return doPath(method, "/db/key", remote)
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusCreated, do(http.MethodPost, "10.0.0.1:1000").StatusCode, "burst")
+	}
+
+	resp := do(http.MethodPost, "10.0.0.1:1001")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.True(t, errors.Is(dbapi.DecodeError(resp), dbapi.ErrRateLimited))
+
+	assert.Equal(t, http.StatusCreated, do(http.MethodGet, "10.0.0.1:1000").StatusCode, "reads are not limited")
+	assert.Equal(t, http.StatusCreated, doPath(http.MethodPost, "/db/_mget", "10.0.0.1:1000").StatusCode, "reads sent as POST are not limited")
+	assert.Equal(t, http.StatusTooManyRequests, doPath(http.MethodPost, "/ns/orders/db/_txn", "10.0.0.1:1000").StatusCode, "transactions are writes")
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "10.0.0.2:1000").StatusCode, "other clients have their own bucket")
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "10.0.0.1:1000").StatusCode, "a token was refilled")
+	assert.Equal(t, http.StatusTooManyRequests, do(http.MethodPost, "10.0.0.1:1000").StatusCode)
+
+	now = now.Add(2 * time.Minute)
+	do(http.MethodPost, "10.0.0.3:1000")
+	assert.Len(t, limiter.buckets, 1, "refilled buckets are forgotten")
+}
+
+func TestOverloadedResponse(t *testing.T) {
+	rw := httptest.NewRecorder()
+	writeWriteError(rw, datastore.ErrOverloaded)
+
+	resp := rw.Result()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.True(t, errors.Is(dbapi.DecodeError(resp), dbapi.ErrOverloaded))
+}
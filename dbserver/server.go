@@ -0,0 +1,268 @@
+// Package dbserver implements the HTTP API of the datastore served by cmd/db.
+package dbserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+	"github.com/VictorGOcking/lab-4/dbapi"
+)
+
+type ResponseStruct struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version,omitempty"`
+}
+
+type RequestStruct struct {
+	Value string `json:"value"`
+}
+
+type MGetRequestStruct struct {
+	Keys []string `json:"keys"`
+}
+
+type MGetResponseStruct struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+// TxnCondition must hold for the transaction to commit. Version pins the key
+// to the version returned by GET (0 for a key that was never written), Value
+// compares the current value and Exists checks whether the key is present.
+type TxnCondition struct {
+	Key     string  `json:"key"`
+	Version *uint64 `json:"version,omitempty"`
+	Value   *string `json:"value,omitempty"`
+	Exists  *bool   `json:"exists,omitempty"`
+}
+
+type TxnOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type TxnRequestStruct struct {
+	Conditions []TxnCondition `json:"conditions"`
+	Operations []TxnOperation `json:"operations"`
+}
+
+// Server serves the default database under /db/ and the namespaces under
+// /ns/<name>/db/.
+type Server struct {
+	db         datastore.Engine
+	namespaces *datastore.Namespaces
+	limits     Limits
+}
+
+func New(db datastore.Engine, namespaces *datastore.Namespaces, limits Limits) *Server {
+	return &Server{db: db, namespaces: namespaces, limits: limits}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/db/", s.routes(s.db))
+	mux.HandleFunc("/db/_namespaces", func(rw http.ResponseWriter, req *http.Request) {
+		handleNamespacesRequest(rw, req, s.namespaces)
+	})
+	mux.HandleFunc("/db/_namespaces/", func(rw http.ResponseWriter, req *http.Request) {
+		handleNamespaceRequest(rw, req, s.namespaces)
+	})
+	mux.HandleFunc("/ns/", s.handleNamespacedRequest)
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		handleMetricsRequest(rw, req, s.db)
+	})
+	return mux
+}
+
+// dbRoutes serves the key-value API of a single database under /db/.
+func (s *Server) routes(db datastore.Engine) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
+		s.handleDBRequest(rw, req, db)
+	})
+	mux.HandleFunc("/db/_mget", func(rw http.ResponseWriter, req *http.Request) {
+		s.handleMGetRequest(rw, req, db)
+	})
+	mux.HandleFunc("/db/_txn", func(rw http.ResponseWriter, req *http.Request) {
+		s.handleTxnRequest(rw, req, db)
+	})
+	mux.HandleFunc("/db/_import", func(rw http.ResponseWriter, req *http.Request) {
+		s.handleImportRequest(rw, req, db)
+	})
+	mux.HandleFunc("/db/_export", func(rw http.ResponseWriter, req *http.Request) {
+		handleExportRequest(rw, req, db)
+	})
+	mux.HandleFunc("/db/_stats", func(rw http.ResponseWriter, req *http.Request) {
+		handleStatsRequest(rw, req, db)
+	})
+	return mux
+}
+
+func (s *Server) handleDBRequest(rw http.ResponseWriter, req *http.Request, db datastore.Engine) {
+	key, err := s.parseKey(req)
+	if err != nil {
+		writeKeyError(rw, err)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		handleGetRequest(rw, key, db)
+	case http.MethodPost:
+		s.handlePostRequest(rw, req, key, db)
+	case http.MethodDelete:
+		handleDeleteRequest(rw, key, db)
+	default:
+		dbapi.MethodNotAllowed(rw, req, http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func handleGetRequest(rw http.ResponseWriter, key string, db datastore.Engine) {
+	var (
+		value   string
+		version uint64
+		err     error
+	)
+	if versioned, ok := db.(*datastore.Db); ok {
+		value, version, err = versioned.GetVersioned(key)
+	} else {
+		value, err = db.Get(key)
+	}
+	if err != nil {
+		writeStorageError(rw, err, fmt.Sprintf("Failed to read key %s", key))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(ResponseStruct{Key: key, Value: value, Version: version})
+}
+
+func (s *Server) handleMGetRequest(rw http.ResponseWriter, req *http.Request, db datastore.Engine) {
+	if req.Method != http.MethodPost {
+		dbapi.MethodNotAllowed(rw, req, http.MethodPost)
+		return
+	}
+
+	var body MGetRequestStruct
+	if !s.decodeBody(rw, req, &body) {
+		return
+	}
+
+	values, missing, err := db.GetMany(body.Keys)
+	if err != nil {
+		writeStorageError(rw, err, "Failed to read values")
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(rw).Encode(MGetResponseStruct{Values: values, Missing: missing})
+}
+
+func (s *Server) handlePostRequest(rw http.ResponseWriter, req *http.Request, key string, db datastore.Engine) {
+	var body RequestStruct
+	if !s.decodeBody(rw, req, &body) {
+		return
+	}
+	if len(body.Value) > s.limits.MaxValueSize {
+		dbapi.WriteError(rw, http.StatusRequestEntityTooLarge, dbapi.CodeTooLarge, fmt.Sprintf("Value of %d bytes is over the limit of %d", len(body.Value), s.limits.MaxValueSize))
+		return
+	}
+
+	if err := db.Put(key, body.Value); err != nil {
+		writeWriteError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// handleDeleteRequest removes the key, answering 204 whether or not it was
+// there.
+func handleDeleteRequest(rw http.ResponseWriter, key string, db datastore.Engine) {
+	if err := db.Delete(key); err != nil {
+		writeStorageError(rw, err, fmt.Sprintf("Failed to delete key %s", key))
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleTxnRequest(rw http.ResponseWriter, req *http.Request, engine datastore.Engine) {
+	if req.Method != http.MethodPost {
+		dbapi.MethodNotAllowed(rw, req, http.MethodPost)
+		return
+	}
+
+	db, ok := engine.(*datastore.Db)
+	if !ok {
+		dbapi.WriteError(rw, http.StatusNotImplemented, dbapi.CodeNotImplemented, "Transactions are not supported by the storage engine")
+		return
+	}
+
+	var body TxnRequestStruct
+	if !s.decodeBody(rw, req, &body) {
+		return
+	}
+
+	txn := db.Begin()
+	defer txn.Discard()
+
+	for _, cond := range body.Conditions {
+		if cond.Version != nil {
+			txn.Require(cond.Key, *cond.Version)
+		}
+		if cond.Value == nil && cond.Exists == nil {
+			continue
+		}
+
+		value, err := txn.Get(cond.Key)
+		if err != nil && err != datastore.ErrNotFound {
+			writeTxnError(rw, err)
+			return
+		}
+
+		exists := err == nil
+		if cond.Exists != nil && *cond.Exists != exists {
+			dbapi.WriteError(rw, http.StatusConflict, dbapi.CodeConflict, fmt.Sprintf("Condition failed for key %s: exists is %t", cond.Key, exists))
+			return
+		}
+		if cond.Value != nil && (!exists || *cond.Value != value) {
+			dbapi.WriteError(rw, http.StatusConflict, dbapi.CodeConflict, fmt.Sprintf("Condition failed for key %s: value does not match", cond.Key))
+			return
+		}
+	}
+
+	for _, op := range body.Operations {
+		var err error
+		switch op.Op {
+		case "put":
+			err = txn.Put(op.Key, op.Value)
+		case "delete":
+			err = txn.Delete(op.Key)
+		default:
+			dbapi.WriteError(rw, http.StatusBadRequest, dbapi.CodeBadRequest, fmt.Sprintf("Unknown operation %q", op.Op))
+			return
+		}
+		if err != nil {
+			writeWriteError(rw, err)
+			return
+		}
+	}
+
+	if err := txn.Commit(); err != nil {
+		writeTxnError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+func writeTxnError(rw http.ResponseWriter, err error) {
+	writeStorageError(rw, err, "Transaction aborted")
+}
@@ -24,9 +24,14 @@ func (s server) Start() {
 }
 
 func CreateServer(port int, handler http.Handler) Server {
+	return CreateServerOn(fmt.Sprintf(":%d", port), handler)
+}
+
+// CreateServerOn creates a server listening on the given host:port address.
+func CreateServerOn(addr string, handler http.Handler) Server {
 	return server{
 		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
+			Addr:           addr,
 			Handler:        handler,
 			ReadTimeout:    10 * time.Second,
 			WriteTimeout:   10 * time.Second,
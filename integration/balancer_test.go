@@ -34,16 +34,16 @@ func TestBalancer(t *testing.T) {
 		description string
 	}{
 		{fmt.Sprintf("%s/api/v2/wtf/mad-data", baseAddress), "server1:8080", "test server #1"},
-		{fmt.Sprintf("%s/api/v1/wow-data", baseAddress), "server2:8080", "test server #2"},
-		{fmt.Sprintf("%s/really/good/end-point", baseAddress), "server3:8080", "test server #3"},
+		{fmt.Sprintf("%s/api/v1/wow-data", baseAddress), "server3:8080", "test server #3"},
+		{fmt.Sprintf("%s/really/good/end-point", baseAddress), "server2:8080", "test server #2"},
 	}
 
 	for _, test := range serverTests {
 		runServerTest(t, test.url, test.expectedLB, test.description)
 	}
 
-	// Test repeated request to server #3
-	runServerTest(t, fmt.Sprintf("%s/really/good/end-point", baseAddress), serverTests[2].expectedLB, "test repeated request to server #3")
+	// Test repeated request to server #2
+	runServerTest(t, fmt.Sprintf("%s/really/good/end-point", baseAddress), serverTests[2].expectedLB, "test repeated request to server #2")
 
 	testDatabaseRequest(t, "victorgocking")
 
@@ -0,0 +1,369 @@
+// Package lbconfig reads the configuration of the backend pool shared by
+// cmd/lb and cmd/stats. Files ending in .json are JSON, anything else is
+// YAML:
+//
+//	strategy: least-connections
+//	timeout: 3s
+//	health_check:
+//	  path: /health
+//	  interval: 10s
+//	  timeout: 3s
+//	  healthy_threshold: 2
+//	  unhealthy_threshold: 3
+//	circuit_breaker:
+//	  failures: 5
+//	  backoff: 5s
+//	  max_backoff: 1m
+//	retries:
+//	  attempts: 3
+//	  on_status: [502, 503, 504]
+//	sticky:
+//	  cookie: lb-server
+//	  max_age: 1h
+//	backends:
+//	  - addr: server1:8080
+//	    weight: 2
+//	  - addr: server2:8080
+//	    health_check:
+//	      path: /ready
+//	      expect_body: OK
+package lbconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is written as a Go duration string, such as "1.5s" or "200ms".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"3s\"")
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return d.parse(node.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Config struct {
+	Backends []Backend `json:"backends" yaml:"backends"`
+	// Strategy is a name accepted by the -strategy flag of cmd/lb.
+	Strategy   string  `json:"strategy" yaml:"strategy"`
+	LoadFactor float64 `json:"load_factor" yaml:"load_factor"`
+	// Timeout bounds every request forwarded to a backend.
+	Timeout     Duration    `json:"timeout" yaml:"timeout"`
+	HealthCheck HealthCheck `json:"health_check" yaml:"health_check"`
+	// CircuitBreaker ejects backends whose requests keep failing.
+	CircuitBreaker CircuitBreaker `json:"circuit_breaker" yaml:"circuit_breaker"`
+	Retries        Retries        `json:"retries" yaml:"retries"`
+	Sticky         Sticky         `json:"sticky" yaml:"sticky"`
+}
+
+type Backend struct {
+	Addr string `json:"addr" yaml:"addr"`
+	// Weight is used by the weighted strategy, zero means 1.
+	Weight int `json:"weight,omitempty" yaml:"weight"`
+	// HealthCheck overrides the settings of the global health check that
+	// are set in it.
+	HealthCheck *HealthCheck `json:"health_check,omitempty" yaml:"health_check"`
+}
+
+type HealthCheck struct {
+	Path     string   `json:"path,omitempty" yaml:"path"`
+	Interval Duration `json:"interval,omitempty" yaml:"interval"`
+	Timeout  Duration `json:"timeout,omitempty" yaml:"timeout"`
+	// ExpectStatus is the status of a healthy response, 200 if zero.
+	ExpectStatus int `json:"expect_status,omitempty" yaml:"expect_status"`
+	// ExpectBody, if set, must be contained in the body of a healthy
+	// response.
+	ExpectBody string `json:"expect_body,omitempty" yaml:"expect_body"`
+	// A backend changes its state after that many checks in a row disagree
+	// with it. Its first check decides its state at once.
+	HealthyThreshold   int `json:"healthy_threshold,omitempty" yaml:"healthy_threshold"`
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty" yaml:"unhealthy_threshold"`
+}
+
+type CircuitBreaker struct {
+	// Failures is the number of failed requests in a row, connection errors,
+	// timeouts or 5xx responses, that ejects a backend.
+	Failures int `json:"failures" yaml:"failures"`
+	// Backoff is how long a backend is ejected for. It doubles, up to
+	// MaxBackoff, every time the backend fails again right after it.
+	Backoff    Duration `json:"backoff" yaml:"backoff"`
+	MaxBackoff Duration `json:"max_backoff" yaml:"max_backoff"`
+}
+
+// Retries of idempotent requests go to another backend when one fails to
+// respond or responds with a status of OnStatus.
+type Retries struct {
+	// Attempts is the most backends a request is sent to, 1 disables
+	// retries.
+	Attempts int   `json:"attempts" yaml:"attempts"`
+	OnStatus []int `json:"on_status" yaml:"on_status"`
+	// Budget is the ratio of retries to requests allowed over time, so that
+	// retries do not pile up on backends that are overloaded already.
+	Budget float64 `json:"budget" yaml:"budget"`
+	// MaxBodySize is the largest request body kept for retries, requests
+	// with larger bodies are not retried.
+	MaxBodySize int64 `json:"max_body_size" yaml:"max_body_size"`
+}
+
+// Sticky sessions send the requests of a client to the backend that served
+// its first one, as long as it is active, by a cookie naming the backend.
+type Sticky struct {
+	// Cookie is the name of the cookie, sticky sessions are off if empty.
+	Cookie string `json:"cookie,omitempty" yaml:"cookie"`
+	// Secret signs the cookie so that clients cannot choose a backend. A
+	// random one is made at start if empty, which ends the sessions on
+	// restart.
+	Secret string `json:"secret,omitempty" yaml:"secret"`
+	// MaxAge is how long the cookie lasts, until the browser closes if zero.
+	MaxAge Duration `json:"max_age,omitempty" yaml:"max_age"`
+}
+
+// merge returns the check with the settings of override that are set.
+func (h HealthCheck) merge(override *HealthCheck) HealthCheck {
+	if override == nil {
+		return h
+	}
+	if override.Path != "" {
+		h.Path = override.Path
+	}
+	if override.Interval.Duration != 0 {
+		h.Interval = override.Interval
+	}
+	if override.Timeout.Duration != 0 {
+		h.Timeout = override.Timeout
+	}
+	if override.ExpectStatus != 0 {
+		h.ExpectStatus = override.ExpectStatus
+	}
+	if override.ExpectBody != "" {
+		h.ExpectBody = override.ExpectBody
+	}
+	if override.HealthyThreshold != 0 {
+		h.HealthyThreshold = override.HealthyThreshold
+	}
+	if override.UnhealthyThreshold != 0 {
+		h.UnhealthyThreshold = override.UnhealthyThreshold
+	}
+	return h
+}
+
+func (h HealthCheck) problems() []error {
+	var errs []error
+	if !strings.HasPrefix(h.Path, "/") {
+		errs = append(errs, fmt.Errorf("health_check.path must start with /"))
+	}
+	if h.Interval.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("health_check.interval must be positive"))
+	}
+	if h.Timeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("health_check.timeout must be positive"))
+	}
+	if h.ExpectStatus != 0 && (h.ExpectStatus < 100 || h.ExpectStatus > 599) {
+		errs = append(errs, fmt.Errorf("health_check.expect_status %d is not an HTTP status", h.ExpectStatus))
+	}
+	if h.HealthyThreshold < 1 || h.UnhealthyThreshold < 1 {
+		errs = append(errs, fmt.Errorf("health_check thresholds must be at least 1"))
+	}
+	return errs
+}
+
+// HealthCheckOf returns the health check of the backend, the global one
+// for backends that are not in the config.
+func (c *Config) HealthCheckOf(addr string) HealthCheck {
+	for _, b := range c.Backends {
+		if b.Addr == addr {
+			return c.HealthCheck.merge(b.HealthCheck)
+		}
+	}
+	return c.HealthCheck
+}
+
+// Default is the pool of the docker-compose setup.
+func Default() *Config {
+	return &Config{
+		Backends: []Backend{
+			{Addr: "server1:8080"},
+			{Addr: "server2:8080"},
+			{Addr: "server3:8080"},
+		},
+		Strategy:   "hash:path",
+		LoadFactor: 1.25,
+		Timeout:    Duration{3 * time.Second},
+		HealthCheck: HealthCheck{
+			Path:               "/health",
+			Interval:           Duration{10 * time.Second},
+			Timeout:            Duration{3 * time.Second},
+			HealthyThreshold:   2,
+			UnhealthyThreshold: 3,
+		},
+		CircuitBreaker: CircuitBreaker{
+			Failures:   5,
+			Backoff:    Duration{5 * time.Second},
+			MaxBackoff: Duration{time.Minute},
+		},
+		Retries: Retries{
+			Attempts:    3,
+			OnStatus:    []int{502, 503, 504},
+			Budget:      0.2,
+			MaxBodySize: 64 << 10,
+		},
+	}
+}
+
+// Load reads and validates the file. Settings missing from it take the
+// values of Default, except for the backends.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Default()
+	config.Backends = nil
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(config)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Validate reports every problem of the config at once.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Backends) == 0 {
+		fail("no backends")
+	}
+	seen := make(map[string]bool)
+	for i, b := range c.Backends {
+		problems := b.problems()
+		if b.HealthCheck != nil {
+			problems = append(problems, c.HealthCheck.merge(b.HealthCheck).problems()...)
+		}
+		for _, err := range problems {
+			fail("backends[%d]: %w", i, err)
+		}
+		if len(problems) == 0 && seen[b.Addr] {
+			fail("backends[%d]: duplicate addr %s", i, b.Addr)
+		}
+		seen[b.Addr] = true
+	}
+
+	if c.LoadFactor < 1 {
+		fail("load_factor must be at least 1")
+	}
+	if c.Timeout.Duration <= 0 {
+		fail("timeout must be positive")
+	}
+	errs = append(errs, c.HealthCheck.problems()...)
+
+	if c.CircuitBreaker.Failures < 1 {
+		fail("circuit_breaker.failures must be at least 1")
+	}
+	if c.CircuitBreaker.Backoff.Duration <= 0 {
+		fail("circuit_breaker.backoff must be positive")
+	}
+	if c.CircuitBreaker.MaxBackoff.Duration < c.CircuitBreaker.Backoff.Duration {
+		fail("circuit_breaker.max_backoff must not be shorter than backoff")
+	}
+
+	if c.Retries.Attempts < 1 {
+		fail("retries.attempts must be at least 1")
+	}
+	for _, status := range c.Retries.OnStatus {
+		if status < 500 || status > 599 {
+			fail("retries.on_status %d is not a 5xx status", status)
+		}
+	}
+	if c.Retries.Budget < 0 {
+		fail("retries.budget must not be negative")
+	}
+	if c.Retries.MaxBodySize < 0 {
+		fail("retries.max_body_size must not be negative")
+	}
+
+	if c.Sticky.Cookie != "" {
+		if err := (&http.Cookie{Name: c.Sticky.Cookie, Value: "x"}).Valid(); err != nil {
+			fail("sticky.cookie: %v", err)
+		}
+	}
+	if c.Sticky.MaxAge.Duration < 0 {
+		fail("sticky.max_age must not be negative")
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b Backend) Validate() error {
+	return errors.Join(b.problems()...)
+}
+
+func (b Backend) problems() []error {
+	var errs []error
+	switch {
+	case b.Addr == "":
+		errs = append(errs, fmt.Errorf("addr is required"))
+	case strings.Contains(b.Addr, "://") || strings.Contains(b.Addr, "/"):
+		errs = append(errs, fmt.Errorf("addr %q must be host:port without a scheme or path", b.Addr))
+	}
+	if b.Weight < 0 {
+		errs = append(errs, fmt.Errorf("weight must not be negative"))
+	}
+	return errs
+}
+
+// Addrs lists the addresses of the backends.
+func (c *Config) Addrs() []string {
+	addrs := make([]string, len(c.Backends))
+	for i, b := range c.Backends {
+		addrs[i] = b.Addr
+	}
+	return addrs
+}
@@ -0,0 +1,192 @@
+package lbconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	yamlPath := writeFile(t, "lb.yaml", `
+strategy: weighted
+timeout: 1500ms
+health_check:
+  interval: 5s
+backends:
+  - addr: server1:8080
+    weight: 3
+  - addr: server2:8080
+`)
+	jsonPath := writeFile(t, "lb.json", `{
+	"strategy": "weighted",
+	"timeout": "1500ms",
+	"health_check": {"interval": "5s"},
+	"backends": [{"addr": "server1:8080", "weight": 3}, {"addr": "server2:8080"}]
+}`)
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		config, err := Load(path)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", path, err)
+		}
+		if config.Strategy != "weighted" || config.Timeout.Duration != 1500*time.Millisecond {
+			t.Errorf("Unexpected settings in %s: %+v", path, config)
+		}
+		if len(config.Backends) != 2 || config.Backends[0].Weight != 3 || config.Backends[1].Addr != "server2:8080" {
+			t.Errorf("Unexpected backends in %s: %+v", path, config.Backends)
+		}
+
+		// Missing settings keep their defaults.
+		if config.HealthCheck.Interval.Duration != 5*time.Second || config.HealthCheck.Path != "/health" || config.LoadFactor != 1.25 {
+			t.Errorf("Defaults were not applied in %s: %+v", path, config)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, content string
+		errors        []string
+	}{
+		{"lb.yaml", "backends: []", []string{"no backends"}},
+		{"lb.yaml", "backend:\n  - addr: a:1", []string{"field backend not found"}},
+		{"lb.json", `{"backends": [{"addr": "a:1"}], "timeout": 3}`, []string{"duration must be a string"}},
+		{"lb.yaml", "timeout: soon\nbackends:\n  - addr: a:1", []string{`invalid duration "soon"`}},
+		{"lb.yaml", `
+timeout: 0s
+load_factor: 0.5
+health_check:
+  path: health
+backends:
+  - addr: a:1
+  - addr: a:1
+  - addr: http://b:1
+  - weight: -1
+`, []string{
+			"backends[1]: duplicate addr a:1",
+			"backends[2]: addr \"http://b:1\" must be host:port",
+			"backends[3]: addr is required",
+			"backends[3]: weight must not be negative",
+			"load_factor must be at least 1",
+			"timeout must be positive",
+			"health_check.path must start with /",
+		}},
+		{"lb.yaml", `
+health_check:
+  unhealthy_threshold: 0
+backends:
+  - addr: a:1
+    health_check:
+      expect_status: 42
+`, []string{
+			"backends[0]: health_check.expect_status 42 is not an HTTP status",
+			"health_check thresholds must be at least 1",
+		}},
+		{"lb.yaml", `
+circuit_breaker:
+  failures: 0
+  backoff: 10s
+  max_backoff: 1s
+backends:
+  - addr: a:1
+`, []string{
+			"circuit_breaker.failures must be at least 1",
+			"circuit_breaker.max_backoff must not be shorter than backoff",
+		}},
+		{"lb.yaml", `
+retries:
+  attempts: 0
+  on_status: [404, 503]
+backends:
+  - addr: a:1
+`, []string{
+			"retries.attempts must be at least 1",
+			"retries.on_status 404 is not a 5xx status",
+		}},
+		{"lb.yaml", `
+sticky:
+  cookie: "lb server"
+  max_age: -1h
+backends:
+  - addr: a:1
+`, []string{
+			"sticky.cookie: http: invalid Cookie.Name",
+			"sticky.max_age must not be negative",
+		}},
+	} {
+		_, err := Load(writeFile(t, tc.name, tc.content))
+		if err == nil {
+			t.Errorf("Expected an error for %q", tc.content)
+			continue
+		}
+		for _, msg := range tc.errors {
+			if !strings.Contains(err.Error(), msg) {
+				t.Errorf("Error %q does not mention %q", err, msg)
+			}
+		}
+	}
+}
+
+func TestHealthCheckOf(t *testing.T) {
+	config, err := Load(writeFile(t, "lb.yaml", `
+health_check:
+  interval: 5s
+  unhealthy_threshold: 2
+backends:
+  - addr: a:1
+  - addr: b:1
+    health_check:
+      path: /ready
+      expect_body: OK
+      unhealthy_threshold: 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if check := config.HealthCheckOf("a:1"); check != config.HealthCheck {
+		t.Errorf("Expected the global check for a:1, got %+v", check)
+	}
+	check := config.HealthCheckOf("b:1")
+	if check.Path != "/ready" || check.ExpectBody != "OK" || check.UnhealthyThreshold != 1 {
+		t.Errorf("Overrides were not applied for b:1: %+v", check)
+	}
+	if check.Interval.Duration != 5*time.Second || check.HealthyThreshold != 2 || check.Timeout.Duration != 3*time.Second {
+		t.Errorf("Global settings were not kept for b:1: %+v", check)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	path := writeFile(t, "lb.yaml", "backends:\n  - addr: a:1\n")
+
+	var reloads atomic.Int32
+	stop := Watch(path, 10*time.Millisecond, func() { reloads.Add(1) })
+	defer stop()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := reloads.Load(); n != 0 {
+		t.Fatalf("Reloaded %d times without changes", n)
+	}
+
+	if err := os.WriteFile(path, []byte("backends:\n  - addr: a:1\n  - addr: b:1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for reloads.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := reloads.Load(); n != 1 {
+		t.Errorf("Expected one reload after the change, got %d", n)
+	}
+}
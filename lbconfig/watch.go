@@ -0,0 +1,51 @@
+package lbconfig
+
+import (
+	"os"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/signal"
+)
+
+// Watch calls reload when the process gets SIGHUP and when the modification
+// time or size of the file changes, checked every interval, until stop is
+// called. Editors that replace the file are noticed as well.
+func Watch(path string, interval time.Duration, reload func()) (stop func()) {
+	hangups, stopHangups := signal.Hangups()
+	done := make(chan struct{})
+
+	go func() {
+		defer stopHangups()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last, _ := os.Stat(path)
+		for {
+			select {
+			case <-done:
+				return
+			case <-hangups:
+				last, _ = os.Stat(path)
+				reload()
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err != nil {
+					// Being replaced, the new file counts as a change.
+					last = nil
+					continue
+				}
+				if changed(last, info) {
+					last = info
+					reload()
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func changed(last, current os.FileInfo) bool {
+	return last == nil || !last.ModTime().Equal(current.ModTime()) || last.Size() != current.Size()
+}
@@ -0,0 +1,83 @@
+package resp
+
+// match reports whether the key matches a Redis glob pattern: * matches any
+// run of characters, ? any single one, [abc], [^abc] and [a-z] a set of
+// them, and \ escapes the next character.
+func match(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if match(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			rest, ok := matchSet(pattern[1:], key[0])
+			if !ok {
+				return false
+			}
+			pattern, key = rest, key[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+// matchSet matches c against the set at the start of the pattern, the
+// opening bracket already consumed, and returns the pattern after the set.
+func matchSet(pattern string, c byte) (string, bool) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		lo := pattern[0]
+		if lo == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			lo = pattern[0]
+		}
+		pattern = pattern[1:]
+
+		hi := lo
+		if len(pattern) > 1 && pattern[0] == '-' && pattern[1] != ']' {
+			hi = pattern[1]
+			pattern = pattern[2:]
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if len(pattern) > 0 {
+		// Skip the closing bracket.
+		pattern = pattern[1:]
+	}
+	return pattern, matched != negate
+}
@@ -0,0 +1,108 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxArgs    = 1 << 20
+	maxBulkLen = 512 << 20
+)
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads a command sent either as an array of bulk strings, the
+// way clients do, or as an inline line of space separated words, the way a
+// person typing into telnet does.
+func readCommand(in *bufio.Reader) ([]string, error) {
+	line, err := readLine(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, errProtocol
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(in)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, errProtocol
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return nil, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, errProtocol
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// writer encodes replies; errors are kept by the underlying bufio.Writer and
+// show up on Flush.
+type writer struct {
+	out *bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	fmt.Fprintf(w.out, "+%s\r\n", s)
+}
+
+func (w writer) error(format string, args ...interface{}) {
+	fmt.Fprintf(w.out, "-%s\r\n", fmt.Sprintf(format, args...))
+}
+
+func (w writer) integer(n int64) {
+	fmt.Fprintf(w.out, ":%d\r\n", n)
+}
+
+func (w writer) bulk(s string) {
+	fmt.Fprintf(w.out, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w writer) null() {
+	w.out.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	fmt.Fprintf(w.out, "*%d\r\n", n)
+}
+
+func (w writer) strings(list []string) {
+	w.array(len(list))
+	for _, s := range list {
+		w.bulk(s)
+	}
+}
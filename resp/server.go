@@ -0,0 +1,488 @@
+// Package resp serves the datastore over the Redis serialization protocol,
+// so redis-cli and Redis client libraries can talk to it.
+package resp
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+)
+
+const (
+	defaultScanCount = 10
+	maxIncrRetries   = 100
+)
+
+// arity is the minimal number of arguments of every supported command.
+var arity = map[string]int{
+	"PING": 0, "GET": 1, "SET": 2, "DEL": 1, "EXISTS": 1,
+	"INCR": 1, "MGET": 1, "KEYS": 1, "SCAN": 1,
+}
+
+// Server answers GET, SET, DEL, EXISTS, INCR, MGET, KEYS, SCAN and PING.
+// Expirations set with SET EX are kept in memory, a key outlives its
+// expiration if the server restarts before it fires. Any later write of the
+// key, through RESP or another API, clears its expiration.
+type Server struct {
+	db *datastore.Db
+
+	mu        sync.Mutex
+	deadlines map[string]deadline
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	stopWatch func()
+	closed    bool
+}
+
+// deadline is the expiration of the write of a key with the given version.
+type deadline struct {
+	at      time.Time
+	version uint64
+}
+
+func NewServer(db *datastore.Db) *Server {
+	s := &Server{
+		db:        db,
+		deadlines: make(map[string]deadline),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	events, stop := db.Watch("")
+	s.stopWatch = stop
+	go s.track(events)
+	return s
+}
+
+// Serve accepts connections until the listener fails or the server is closed.
+func (s *Server) Serve(lis net.Listener) error {
+	s.mu.Lock()
+	s.listeners[lis] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// Close stops the listeners and drops the open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.stopWatch()
+	for lis := range s.listeners {
+		lis.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	in := bufio.NewReader(conn)
+	w := writer{out: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(in)
+		if err == errProtocol {
+			w.error("ERR Protocol error")
+			w.out.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("RESP connection from %s failed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if strings.ToUpper(args[0]) == "QUIT" {
+			w.simple("OK")
+			w.out.Flush()
+			return
+		}
+		s.exec(w, args)
+
+		// Pipelined commands are answered together.
+		if in.Buffered() == 0 {
+			if err := w.out.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) exec(w writer, args []string) {
+	name := strings.ToUpper(args[0])
+	min, ok := arity[name]
+	if !ok {
+		w.error("ERR unknown command '%s'", args[0])
+		return
+	}
+
+	args = args[1:]
+	if len(args) < min {
+		w.error("ERR wrong number of arguments for '%s' command", strings.ToLower(name))
+		return
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 0 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "GET":
+		s.get(w, args[0])
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		s.del(w, args)
+	case "EXISTS":
+		s.exists(w, args)
+	case "INCR":
+		s.incr(w, args[0])
+	case "MGET":
+		s.mget(w, args)
+	case "KEYS":
+		s.keys(w, args[0])
+	case "SCAN":
+		s.scan(w, args)
+	}
+}
+
+func (s *Server) get(w writer, key string) {
+	value, err := s.db.Get(key)
+	if err == datastore.ErrNotFound || s.expired(key) {
+		w.null()
+		return
+	}
+	if err != nil {
+		w.error("ERR %v", err)
+		return
+	}
+	w.bulk(value)
+}
+
+// set handles SET key value [EX seconds | PX milliseconds].
+func (s *Server) set(w writer, args []string) {
+	key, value := args[0], args[1]
+
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		var unit time.Duration
+		switch strings.ToUpper(args[i]) {
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+		if i+1 >= len(args) || ttl != 0 {
+			w.error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			w.error("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * unit
+		i++
+	}
+
+	// The old expiration goes away before the write, see expire.
+	s.persist(key)
+	version, err := s.db.PutVersioned(key, value)
+	if err != nil {
+		w.error("ERR %v", err)
+		return
+	}
+	if ttl > 0 {
+		s.expire(key, version, ttl)
+	}
+	w.simple("OK")
+}
+
+func (s *Server) del(w writer, keys []string) {
+	var deleted int64
+	for _, key := range keys {
+		if _, err := s.db.Get(key); err != nil || s.expired(key) {
+			continue
+		}
+		s.persist(key)
+		if err := s.db.Delete(key); err != nil {
+			w.error("ERR %v", err)
+			return
+		}
+		deleted++
+	}
+	w.integer(deleted)
+}
+
+func (s *Server) exists(w writer, keys []string) {
+	values, _, err := s.db.GetMany(keys)
+	if err != nil {
+		w.error("ERR %v", err)
+		return
+	}
+
+	var count int64
+	for _, key := range keys {
+		if _, ok := values[key]; ok && !s.expired(key) {
+			count++
+		}
+	}
+	w.integer(count)
+}
+
+// incr increments the integer value of the key in a transaction, retrying
+// when a concurrent write gets in between.
+func (s *Server) incr(w writer, key string) {
+	for i := 0; i < maxIncrRetries; i++ {
+		txn := s.db.Begin()
+
+		var n int64
+		value, err := txn.Get(key)
+		if err != nil && err != datastore.ErrNotFound {
+			txn.Discard()
+			w.error("ERR %v", err)
+			return
+		}
+		if err == nil && !s.expired(key) {
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil || n == 1<<63-1 {
+				txn.Discard()
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+		}
+
+		n++
+		_ = txn.Put(key, strconv.FormatInt(n, 10))
+		err = txn.Commit()
+		if err == datastore.ErrConflict {
+			continue
+		}
+		if err != nil {
+			w.error("ERR %v", err)
+			return
+		}
+		w.integer(n)
+		return
+	}
+	w.error("ERR too many concurrent updates of the key")
+}
+
+func (s *Server) mget(w writer, keys []string) {
+	values, _, err := s.db.GetMany(keys)
+	if err != nil {
+		w.error("ERR %v", err)
+		return
+	}
+
+	w.array(len(keys))
+	for _, key := range keys {
+		if value, ok := values[key]; ok && !s.expired(key) {
+			w.bulk(value)
+		} else {
+			w.null()
+		}
+	}
+}
+
+func (s *Server) keys(w writer, pattern string) {
+	keys, err := s.db.Keys("", 0)
+	if err != nil {
+		w.error("ERR %v", err)
+		return
+	}
+
+	matched := make([]string, 0)
+	for _, key := range keys {
+		if match(pattern, key) && !s.expired(key) {
+			matched = append(matched, key)
+		}
+	}
+	w.strings(matched)
+}
+
+// scan handles SCAN cursor [MATCH pattern] [COUNT count]. The cursor is the
+// position in the sorted list of keys, so keys added or removed during a
+// scan may be missed or returned twice, as Redis allows.
+func (s *Server) scan(w writer, args []string) {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		w.error("ERR invalid cursor")
+		return
+	}
+
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	keys, err := s.db.Keys("", 0)
+	if err != nil {
+		w.error("ERR %v", err)
+		return
+	}
+	matched := make([]string, 0)
+	next := cursor
+	for ; next < len(keys) && next < cursor+count; next++ {
+		if match(pattern, keys[next]) && !s.expired(keys[next]) {
+			matched = append(matched, keys[next])
+		}
+	}
+	if next >= len(keys) {
+		next = 0
+	}
+
+	w.array(2)
+	w.bulk(strconv.Itoa(next))
+	w.strings(matched)
+}
+
+// expire deletes the write of the key with the given version once the ttl
+// has passed, unless the key has been written again in the meantime. Reads
+// treat the key as missing from the deadline on, even before it is deleted.
+func (s *Server) expire(key string, version uint64, ttl time.Duration) {
+	d := deadline{at: time.Now().Add(ttl), version: version}
+
+	s.mu.Lock()
+	s.deadlines[key] = d
+	s.mu.Unlock()
+
+	// A write that landed before the deadline was set is not cleared by
+	// track, the deadline is not for it.
+	if _, current, _ := s.db.GetVersioned(key); current != version {
+		s.mu.Lock()
+		if s.deadlines[key] == d {
+			delete(s.deadlines, key)
+		}
+		s.mu.Unlock()
+		return
+	}
+
+	time.AfterFunc(ttl, func() {
+		// Reading through the transaction first makes a write that
+		// lands after the deadline check fail the commit.
+		txn := s.db.Begin()
+		defer txn.Discard()
+		if _, err := txn.Get(key); err != nil {
+			return
+		}
+		_, current, _ := s.db.GetVersioned(key)
+
+		s.mu.Lock()
+		if s.deadlines[key] != d || current != d.version {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.deadlines, key)
+		s.mu.Unlock()
+
+		_ = txn.Delete(key)
+		_ = txn.Commit()
+	})
+}
+
+// expired reports whether the deadline of the key has passed.
+func (s *Server) expired(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.deadlines[key]
+	return ok && !time.Now().Before(d.at)
+}
+
+// track clears the deadline of a key on every later write of it, made over
+// RESP or any other API of the database. A watcher that falls behind is
+// dropped by the database, so the deadlines are checked against the stored
+// versions before watching again.
+func (s *Server) track(events <-chan datastore.Event) {
+	for {
+		for event := range events {
+			s.mu.Lock()
+			if d, ok := s.deadlines[event.Key]; ok && event.Version > d.version {
+				delete(s.deadlines, event.Key)
+			}
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		var stop func()
+		events, stop = s.db.Watch("")
+		s.stopWatch = stop
+		keys := make([]string, 0, len(s.deadlines))
+		for key := range s.deadlines {
+			keys = append(keys, key)
+		}
+		s.mu.Unlock()
+
+		for _, key := range keys {
+			_, version, _ := s.db.GetVersioned(key)
+			s.mu.Lock()
+			if d, ok := s.deadlines[key]; ok && version > d.version {
+				delete(s.deadlines, key)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) persist(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deadlines, key)
+}
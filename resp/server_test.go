@@ -0,0 +1,250 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictorGOcking/lab-4/datastore"
+)
+
+// client speaks raw RESP, the way redis-cli does.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+func (c *client) do(args ...string) interface{} {
+	c.t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+// read decodes a reply: simple strings as string, errors as error, integers
+// as int64, bulk strings as string or nil, arrays as []interface{}.
+func (c *client) read() interface{} {
+	c.t.Helper()
+
+	line, err := c.in.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	var n int
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		var i int64
+		fmt.Sscan(line[1:], &i)
+		return i
+	case '$':
+		fmt.Sscan(line[1:], &n)
+		if n < 0 {
+			return nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.in, data); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(data[:n])
+	case '*':
+		fmt.Sscan(line[1:], &n)
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = c.read()
+		}
+		return list
+	}
+	c.t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resp-testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := datastore.NewDb(dir, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db)
+	go server.Serve(lis)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &client{t: t, conn: conn, in: bufio.NewReader(conn)}
+
+	expect := func(t *testing.T, expected interface{}, args ...string) {
+		t.Helper()
+		if got := c.do(args...); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%v: expected %#v, got %#v", args, expected, got)
+		}
+	}
+
+	t.Run("PING", func(t *testing.T) {
+		expect(t, "PONG", "PING")
+		expect(t, "hello", "ping", "hello")
+	})
+
+	t.Run("GET, SET, DEL and EXISTS", func(t *testing.T) {
+		expect(t, nil, "GET", "a")
+		expect(t, "OK", "SET", "a", "1")
+		expect(t, "OK", "SET", "b", "2")
+		expect(t, "1", "GET", "a")
+		expect(t, int64(3), "EXISTS", "a", "b", "a", "c")
+		expect(t, int64(1), "DEL", "a", "c")
+		expect(t, nil, "GET", "a")
+	})
+
+	t.Run("MGET", func(t *testing.T) {
+		expect(t, []interface{}{nil, "2"}, "MGET", "a", "b")
+	})
+
+	t.Run("INCR", func(t *testing.T) {
+		expect(t, int64(1), "INCR", "counter")
+		expect(t, int64(2), "INCR", "counter")
+		expect(t, "2", "GET", "counter")
+		if _, ok := c.do("INCR", "b").(error); ok {
+			t.Errorf("Expected an error incrementing a non-integer")
+		}
+		c.do("SET", "b", "x")
+		if _, ok := c.do("INCR", "b").(error); !ok {
+			t.Errorf("Expected an error incrementing a non-integer")
+		}
+	})
+
+	t.Run("SET EX", func(t *testing.T) {
+		expect(t, "OK", "SET", "temp", "value", "PX", "100")
+		expect(t, "OK", "SET", "kept", "value", "PX", "100")
+		expect(t, "OK", "SET", "kept", "again")
+		expect(t, "value", "GET", "temp")
+		time.Sleep(300 * time.Millisecond)
+		expect(t, nil, "GET", "temp")
+		expect(t, "again", "GET", "kept")
+		if _, ok := c.do("SET", "temp", "value", "EX", "zero").(error); !ok {
+			t.Errorf("Expected an error for an invalid expire time")
+		}
+	})
+
+	t.Run("Writes of other APIs clear the expiration", func(t *testing.T) {
+		expect(t, "OK", "SET", "shared", "value", "PX", "100")
+		if err := db.Put("shared", "direct"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		expect(t, "direct", "GET", "shared")
+	})
+
+	t.Run("Expiration is kept to the write it was set with", func(t *testing.T) {
+		// Another client writes between the SET and its expiration.
+		version, err := db.PutVersioned("raced", "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("raced", "other"); err != nil {
+			t.Fatal(err)
+		}
+		// The watcher is past the other write by the time the expiration
+		// is set, so it does not clear it.
+		time.Sleep(50 * time.Millisecond)
+		server.expire("raced", version, 100*time.Millisecond)
+
+		time.Sleep(300 * time.Millisecond)
+		expect(t, "other", "GET", "raced")
+	})
+
+	t.Run("Expired keys are hidden until deleted", func(t *testing.T) {
+		expect(t, "OK", "SET", "stale", "value")
+		_, version, _ := db.GetVersioned("stale")
+		server.mu.Lock()
+		server.deadlines["stale"] = deadline{at: time.Now().Add(-time.Second), version: version}
+		server.mu.Unlock()
+
+		expect(t, nil, "GET", "stale")
+		expect(t, []interface{}{nil}, "MGET", "stale")
+		expect(t, int64(0), "EXISTS", "stale")
+	})
+
+	t.Run("KEYS and SCAN", func(t *testing.T) {
+		for i := 0; i < 15; i++ {
+			c.do("SET", fmt.Sprintf("user:%02d", i), "x")
+		}
+		expect(t, []interface{}{"user:10", "user:11", "user:12", "user:13", "user:14"}, "KEYS", "user:1?")
+
+		cursor, seen := "0", 0
+		for {
+			reply := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "4").([]interface{})
+			cursor = reply[0].(string)
+			seen += len(reply[1].([]interface{}))
+			if cursor == "0" {
+				break
+			}
+		}
+		if seen != 15 {
+			t.Errorf("Expected SCAN to return 15 keys, got %d", seen)
+		}
+	})
+
+	t.Run("Unknown command", func(t *testing.T) {
+		if _, ok := c.do("FLUSHALL").(error); !ok {
+			t.Errorf("Expected an error for an unknown command")
+		}
+		expect(t, "PONG", "PING")
+	})
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		expected     bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "admin:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"*llo*", "hello world", true},
+	} {
+		if got := match(tc.pattern, tc.key); got != tc.expected {
+			t.Errorf("match(%q, %q): expected %t, got %t", tc.pattern, tc.key, tc.expected, got)
+		}
+	}
+}
@@ -8,8 +8,16 @@ import (
 )
 
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-intChannel
 	log.Println("Shutting down...")
 }
+
+// Hangups delivers the SIGHUPs the process gets, the usual request to reload
+// the configuration, until stop is called.
+func Hangups() (<-chan os.Signal, func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	return ch, func() { signal.Stop(ch) }
+}